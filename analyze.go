@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const analyzeUsage = "usage: go-netflow analyze <capture.pcap|capture.pcapng>... [-ports 8080,443] [-family all] [-interval 1s] [-sinks jsonl,csv]"
+
+//离线分析抓包文件，按端口、方向和采样间隔汇总成与实时采集相同的RootNetFlow序列，
+//默认以json逐行打印到标准输出，指定-sinks时交给对应的输出
+func analyzeMain(args []string) int {
+	//文件名可以写在参数的前面或后面
+	var files []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		files = append(files, args[0])
+		args = args[1:]
+	}
+	_ = flagSet.Parse(args)
+	files = append(files, flagSet.Args()...)
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, analyzeUsage)
+		return 2
+	}
+
+	//标准输出用于打印结果，不打印INIT_LOG的提示
+	g_log = GetDefaultLogger("./netflow.log", "./netflow.log", *logLevel)
+	g_log.SetAdditionalStackDepth(1)
+	defer LOG_FLUSH()
+
+	portsList, errs := parsePortsList(*ports)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	families, err := parseFamilies(*family)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *interval <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid interval %v\n", *interval)
+		return 2
+	}
+	config := &collectConfig{
+		backend:   "analyze",
+		portsList: portsList,
+		families:  families,
+		interval:  *interval,
+	}
+
+	sinksSet := false
+	flagSet.Visit(func(f *flag.Flag) {
+		if f.Name == "sinks" {
+			sinksSet = true
+		}
+	})
+
+	var emit func(flow *RootNetFlow)
+	if sinksSet {
+		dispatcher, err := newSinkDispatcher(strings.Split(*sinks, ","), *sinkBuf, sinkFlags)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer dispatcher.Close()
+		emit = dispatcher.dispatchWait
+	} else {
+		encoder := json.NewEncoder(os.Stdout)
+		emit = func(flow *RootNetFlow) {
+			_ = encoder.Encode(flow)
+		}
+	}
+
+	code := 0
+	for _, file := range files {
+		if err := analyzeFile(file, config, emit); err != nil {
+			fmt.Fprintf(os.Stderr, "analyze %s fail: %v\n", file, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+//分析一个抓包文件，每个文件是独立的序列
+func analyzeFile(path string, config *collectConfig, emit func(flow *RootNetFlow)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := openCapture(file)
+	if err != nil {
+		return err
+	}
+
+	a := &captureAnalyzer{config: config, emit: emit}
+	for {
+		packet, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//已经读到的数据仍然输出
+			a.finish()
+			return err
+		}
+		a.add(packet)
+	}
+	a.finish()
+
+	fmt.Fprintf(os.Stderr, "analyze %s: %d packets, %d not counted (non-ip or no ports), %d bad timestamps, %d flows\n",
+		path, a.packets, a.skipped, a.badTime, a.flows)
+	return nil
+}
+
+//两个报文之间最多输出的空窗口数，超过的时间戳视为错误
+const analyzeMaxEmptyWindows = 100000
+
+//按报文的时间戳划分采样窗口，窗口与unix时间按间隔对齐，没有报文的窗口输出0
+//早于第一个窗口或比之前的报文晚了analyzeMaxEmptyWindows个窗口以上的报文，时间戳视为错误，不计入
+type captureAnalyzer struct {
+	config *collectConfig
+	emit   func(flow *RootNetFlow)
+	agg    *flowAggregator
+	start  time.Time //当前窗口的起点
+	first  time.Time //第一个窗口的起点
+	latest time.Time //已计入的报文中最晚的时间戳
+
+	packets int
+	skipped int
+	badTime int
+	flows   int
+}
+
+func (a *captureAnalyzer) add(packet *capturePacket) {
+	a.packets++
+	interval := a.config.interval
+	if a.agg == nil {
+		nanos := packet.timestamp.UnixNano()
+		a.start = time.Unix(0, nanos-nanos%int64(interval))
+		a.first = a.start
+		a.latest = packet.timestamp
+		a.agg = newFlowAggregator(a.config)
+	}
+	if packet.timestamp.Before(a.first) || packet.timestamp.Sub(a.latest)/interval > analyzeMaxEmptyWindows {
+		a.badTime++
+		return
+	}
+	if packet.timestamp.After(a.latest) {
+		a.latest = packet.timestamp
+	}
+	//乱序的报文计入当前窗口
+	for !packet.timestamp.Before(a.start.Add(interval)) {
+		a.flush()
+	}
+
+	info, ok := decodePacket(packet.linkType, packet.data)
+	if !ok {
+		a.skipped++
+		return
+	}
+	//与iptables一致按ip报文长度计数，长度为0（如TSO）时用抓包记录的长度
+	length := info.length
+	if length <= 0 {
+		length = packet.length
+	}
+	a.agg.add(&decodedFlow{
+		srcPort: info.srcPort,
+		dstPort: info.dstPort,
+		proto:   info.proto,
+		family:  info.family,
+		bytes:   uint64(length),
+		packets: 1,
+	})
+}
+
+//输出当前窗口并开始下一个窗口
+func (a *captureAnalyzer) flush() {
+	end := a.start.Add(a.config.interval)
+	flow := newRootNetFlow(a.config.portsList)
+	flow.WindowStart = a.start.UnixMilli()
+	flow.WindowEnd = end.UnixMilli()
+	flow.Timestamp = end.Unix()
+	for _, key := range a.config.flowKeys() {
+		flow.add(key, a.agg.counters[key], a.config.interval.Seconds())
+	}
+	a.emit(flow)
+	a.flows++
+
+	a.start = end
+	a.agg = newFlowAggregator(a.config)
+}
+
+func (a *captureAnalyzer) finish() {
+	if a.agg != nil {
+		a.flush()
+	}
+}
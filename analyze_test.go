@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCapture(ts time.Time, srcPort, dstPort uint16, length int) *capturePacket {
+	data := testIPv4Packet(srcPort, dstPort, length)
+	return &capturePacket{timestamp: ts, linkType: linkTypeRaw, data: data, length: len(data)}
+}
+
+func TestCaptureAnalyzerWindows(t *testing.T) {
+	config := &collectConfig{
+		portsList: []portSpec{{proto: "tcp", port: 8080}},
+		families:  []int{familyIPv4},
+		interval:  10 * time.Second,
+	}
+	var flows []*RootNetFlow
+	a := &captureAnalyzer{config: config, emit: func(flow *RootNetFlow) { flows = append(flows, flow) }}
+
+	base := time.Unix(1700000000, 0) //按10s对齐
+	a.add(testCapture(base.Add(3*time.Second), 40000, 8080, 100))
+	a.add(testCapture(base.Add(9*time.Second), 8080, 40000, 1000))
+	//早于第一个窗口
+	a.add(testCapture(base.Add(-time.Second), 40000, 8080, 100))
+	//中间空两个窗口
+	a.add(testCapture(base.Add(35*time.Second), 40000, 8080, 200))
+	//乱序的报文计入当前窗口
+	a.add(testCapture(base.Add(12*time.Second), 40000, 8080, 300))
+	//损坏的时间戳不能输出大量空窗口
+	a.add(testCapture(base.Add(100*365*24*time.Hour), 40000, 8080, 100))
+	a.add(testCapture(time.Unix(0, 0), 40000, 8080, 100))
+	a.finish()
+
+	if a.packets != 7 || a.badTime != 3 || a.flows != 4 {
+		t.Fatalf("packets %d, bad timestamps %d, flows %d", a.packets, a.badTime, a.flows)
+	}
+	want := []struct {
+		start   int64
+		inBytes int64
+		out     int64
+	}{
+		{1700000000000, 100, 1000},
+		{1700000010000, 0, 0},
+		{1700000020000, 0, 0},
+		{1700000030000, 500, 0},
+	}
+	for i, w := range want {
+		flow := flows[i]
+		if flow.WindowStart != w.start || flow.WindowEnd != w.start+10000 || flow.Timestamp != w.start/1000+10 {
+			t.Errorf("window %d: %d-%d, timestamp %d", i, flow.WindowStart, flow.WindowEnd, flow.Timestamp)
+		}
+		if flow.InBytes != w.inBytes || flow.OutBytes != w.out || flow.Ports[0].InBytes != w.inBytes {
+			t.Errorf("window %d: in %d, out %d", i, flow.InBytes, flow.OutBytes)
+		}
+	}
+	if flows[0].InRate != 10 || flows[0].OutPackets != 1 {
+		t.Errorf("window 0: in rate %v, out packets %d", flows[0].InRate, flows[0].OutPackets)
+	}
+}
+
+func TestAnalyzeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	data := buildPcap(binary.LittleEndian, pcapMagicMicro, linkTypeRaw, []testCapturePacket{
+		{1700000000, 0, testIPv4Packet(40000, 8080, 60)},
+		{1700000001, 0, testIPv4Packet(40000, 53, 60)},
+		{1700000002, 0, testIPv4Packet(8080, 40000, 1500)},
+	})
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &collectConfig{
+		portsList: []portSpec{{proto: "tcp", port: 8080}},
+		families:  []int{familyIPv4},
+		interval:  time.Second,
+	}
+	var flows []*RootNetFlow
+	if err := analyzeFile(path, config, func(flow *RootNetFlow) { flows = append(flows, flow) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 3 || flows[0].InBytes != 60 || flows[1].InBytes != 0 || flows[2].OutBytes != 1500 {
+		t.Fatalf("flows %+v", flows)
+	}
+
+	//截断的文件返回错误，已经读到的窗口仍然输出
+	if err := ioutil.WriteFile(path, data[:len(data)-10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	flows = nil
+	if err := analyzeFile(path, config, func(flow *RootNetFlow) { flows = append(flows, flow) }); err == nil || len(flows) != 2 {
+		t.Fatalf("truncated file: err %v, %d flows", err, len(flows))
+	}
+}
@@ -9,142 +9,245 @@ import (
 	"strings"
 )
 
-func (server *NetFlowServer) flowCollect() (in, out int64, err error) {
+const defaultCollector = "iptables"
 
-	//因为Linux的流量是累加值，所以要通过历史的计数器相减再除采集间隔获取秒级的出入口流量
+//iptables后端只在自有链里建规则，规则用注释标记，读取和删除都只认这个标记
+const (
+	iptablesInChain  = "NETFLOW_IN"
+	iptablesOutChain = "NETFLOW_OUT"
+	iptablesJumpTag  = "netflow:jump"
+)
 
-	server.mux.Lock()
-	defer server.mux.Unlock()
+var (
+	//各地址族对应的命令，ipv6的规则镜像到ip6tables
+	iptablesCommands     = [...]string{familyIPv4: "iptables", familyIPv6: "ip6tables"}
+	iptablesSaveCommands = [...]string{familyIPv4: "iptables-save", familyIPv6: "ip6tables-save"}
 
-	for _, collectInfo := range server.portsFlowCounters {
+	//内置链 -> 自有链
+	iptablesChains = map[string]string{
+		"INPUT":  iptablesInChain,
+		"OUTPUT": iptablesOutChain,
+	}
+)
 
-		if collectInfo.port <= 0 {
-			continue
-		}
+//规则注释，格式为 netflow:<proto>/<port>:<dir>
+func iptablesTag(spec portSpec, direction string) string {
+	return fmt.Sprintf("netflow:%s:%s", spec, direction)
+}
 
-		InOlderCounter := collectInfo.inFlow
-		OutOlderCounter := collectInfo.outFlow
+//解析规则注释，非自有规则返回false
+func parseIptablesTag(tag string) (spec portSpec, direction string, ok bool) {
+	fields := strings.Split(tag, ":")
+	if len(fields) != 3 || fields[0] != "netflow" {
+		return portSpec{}, "", false
+	}
+	spec, err := parsePortSpec(fields[1])
+	if err != nil {
+		return portSpec{}, "", false
+	}
+	if fields[2] != "in" && fields[2] != "out" {
+		return portSpec{}, "", false
+	}
+	return spec, fields[2], true
+}
 
-		InCurrentCounter, errIn := getPortInFlowByIptables(collectInfo.port)
-		OutCurrentCounter, errOut := getPortOutFlowByIptables(collectInfo.port)
+//基于iptables计数规则的采集后端
+type iptablesCollector struct {
+	config *collectConfig
+}
 
-		if errIn == nil {
-			collectInfo.inFlow = InCurrentCounter
-			tempIn := (InCurrentCounter - InOlderCounter) / int64(server.collectIntervalSec)
-			if tempIn < 0 {
-				tempIn = 0
-			}
-			in += tempIn
-		} else {
-			LOG_ERROR(errIn)
-		}
+func init() {
+	RegisterCollector("iptables", func(config *collectConfig) Collector {
+		return &iptablesCollector{config: config}
+	})
+}
 
-		if errOut == nil {
-			collectInfo.outFlow = OutCurrentCounter
-			tempOut := (OutCurrentCounter - OutOlderCounter) / int64(server.collectIntervalSec)
-			if tempOut < 0 {
-				tempOut = 0
-			}
-			out += tempOut
-		} else {
-			LOG_ERROR(errOut)
+func (c *iptablesCollector) Sample() (map[flowKey]*flowCounter, error) {
+	counters := make(map[flowKey]*flowCounter)
+	for _, family := range c.config.families {
+		familyCounters, err := c.sampleFamily(family)
+		if err != nil {
+			LOG_ERROR(err)
+			continue
+		}
+		for key, counter := range familyCounters {
+			counters[key] = counter
 		}
 	}
-	return
+	return counters, nil
 }
 
-//通过iptables获取入站流量
-func getPortInFlowByIptables(port int) (int64, error) {
-	portStr := strconv.Itoa(port)
-	cmd := []*exec.Cmd{
-		exec.Command("iptables", "-L", "-v", "-n", "-x"),
-		exec.Command("grep", "tcp dpt:"+portStr),
-		exec.Command("awk", "{print $2}"),
-		exec.Command("head", "-n", "1"),
+//读取单个地址族的计数
+func (c *iptablesCollector) sampleFamily(family int) (map[flowKey]*flowCounter, error) {
+
+	//优先直接读取内核规则计数，一次拿到所有端口
+	counters, err := readIptablesCounters(family, c.config.portsList)
+	if err == nil && completeCounters(counters, family, c.config.portsList) {
+		return counters, nil
 	}
-	data, err := ExecPipeLine(cmd...)
 	if err != nil {
-		return 0, err
+		LOG_DEBUG_F("read %s xtables counters fail, fallback to %s: %v", familyNames[family], iptablesSaveCommands[family], err)
 	}
 
-	data = strings.ReplaceAll(data, "\n", "")
+	//读不到的端口（如iptables-nft环境）退回到iptables-save快照
+	saved, errSave := readIptablesSaveCounters(family, c.config.portsList)
+	if errSave != nil {
+		if err != nil {
+			return nil, errSave
+		}
+		LOG_ERROR(errSave)
+		return counters, nil
+	}
+	if counters == nil {
+		return saved, nil
+	}
+	for key, counter := range saved {
+		if old, ok := counters[key]; !ok || (old.missing() && !counter.missing()) {
+			counters[key] = counter
+		}
+	}
+	return counters, nil
+}
 
-	count, err := strconv.Atoi(data)
-	if err != nil {
-		return 0, err
+//所有端口的入站和出站计数是否都已读到
+func completeCounters(counters map[flowKey]*flowCounter, family int, portsList []portSpec) bool {
+	for _, spec := range portsList {
+		counter, ok := counters[flowKey{portSpec: spec, family: family}]
+		if !ok || counter.missing() {
+			return false
+		}
 	}
-	return int64(count), nil
+	return true
 }
 
-//通过iptables获取出站流量
-func getPortOutFlowByIptables(port int) (int64, error) {
-	portStr := strconv.Itoa(port)
-	cmd := []*exec.Cmd{
-		exec.Command("iptables", "-L", "-v", "-n", "-x"),
-		exec.Command("grep", "tcp spt:"+portStr),
-		exec.Command("awk", "{print $2}"),
-		exec.Command("head", "-n", "1"),
+//通过一次iptables-save快照获取所有端口的计数
+func readIptablesSaveCounters(family int, portsList []portSpec) (map[flowKey]*flowCounter, error) {
+	data, err := ExecCommand(exec.Command(iptablesSaveCommands[family], "-c", "-t", "filter"))
+	if err != nil {
+		return nil, err
 	}
-	data, err := ExecPipeLine(cmd...)
+	return iptablesSaveCounters(data, family, portsList)
+}
+
+//从iptables-save -c的输出中按规则注释取出各端口的计数
+func iptablesSaveCounters(data string, family int, portsList []portSpec) (map[flowKey]*flowCounter, error) {
+	rules, err := parseIptablesSave(data)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	data = strings.ReplaceAll(data, "\n", "")
+	inFlows := make(map[portSpec]*ruleCounter)
+	outFlows := make(map[portSpec]*ruleCounter)
+	for _, rule := range rules {
+		if rule.table != "filter" || (rule.chain != iptablesInChain && rule.chain != iptablesOutChain) {
+			continue
+		}
+		comment, ok := rule.option("--comment")
+		if !ok {
+			continue
+		}
+		spec, direction, ok := parseIptablesTag(comment)
+		if !ok {
+			continue
+		}
+		switch direction {
+		case "in":
+			addRuleCounter(inFlows, spec, rule.packets, rule.bytes)
+		case "out":
+			addRuleCounter(outFlows, spec, rule.packets, rule.bytes)
+		}
+	}
 
-	count, err := strconv.Atoi(data)
-	if err != nil {
-		return 0, err
+	//入站和出站分别处理，一个方向的规则丢失不影响另一个方向
+	counters := make(map[flowKey]*flowCounter, len(portsList))
+	for _, spec := range portsList {
+		inFlow := inFlows[spec]
+		outFlow := outFlows[spec]
+		if inFlow == nil && outFlow == nil {
+			LOG_ERROR_F("%s rules of port %s not found", iptablesCommands[family], spec)
+			continue
+		}
+		counter := newFlowCounter(inFlow, outFlow)
+		if counter.missing() {
+			LOG_ERROR_F("%s %s rule of port %s not found", iptablesCommands[family], counter.missingNames(), spec)
+		}
+		counters[flowKey{portSpec: spec, family: family}] = counter
 	}
-	return int64(count), nil
+	return counters, nil
 }
 
-func (server *NetFlowServer) cleanRecords() {
+func (c *iptablesCollector) Teardown() error {
 
 	LOG_DEBUG(">>>>>>>>>>>> clean records")
 
-	portsList := server.portsList
-	for _, port := range portsList {
-		LOG_INFO_F("init iptables with port : %d", port)
+	for _, family := range c.config.families {
+		iptables := iptablesCommands[family]
 
-		dcmd := []*exec.Cmd{
-			exec.Command("iptables", "-D", "INPUT", "-p", "tcp", "--dport", fmt.Sprintf("%d", port)),
+		//只删除带自有标记的跳转规则，可能重复添加过，删到没有为止
+		for hook, chain := range iptablesChains {
+			for {
+				_, err := ExecCommand(exec.Command(iptables, "-D", hook, "-j", chain, "-m", "comment", "--comment", iptablesJumpTag))
+				if err != nil {
+					break
+				}
+			}
 		}
-		ExecPipeLine(dcmd...)
 
-		scmd := []*exec.Cmd{
-			exec.Command("iptables", "-D", "INPUT", "-p", "tcp", "--sport", fmt.Sprintf("%d", port)),
+		//自有链整条清空删除，不会影响其他规则
+		for _, chain := range iptablesChains {
+			ExecCommand(exec.Command(iptables, "-F", chain))
+			ExecCommand(exec.Command(iptables, "-X", chain))
 		}
-		ExecPipeLine(scmd...)
+	}
+	return nil
+}
 
-		dcmd1 := []*exec.Cmd{
-			exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "--dport", fmt.Sprintf("%d", port)),
-		}
-		ExecPipeLine(dcmd1...)
+func (c *iptablesCollector) Setup() error {
 
-		scmd1 := []*exec.Cmd{
-			exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "--sport", fmt.Sprintf("%d", port)),
+	LOG_DEBUG(">>>>>>>>>>>> setup records")
+
+	for _, family := range c.config.families {
+		if err := c.setupFamily(iptablesCommands[family]); err != nil {
+			return err
 		}
-		ExecPipeLine(scmd1...)
 	}
+	return nil
 }
 
-func (server *NetFlowServer) setupRecords() {
+func (c *iptablesCollector) setupFamily(iptables string) error {
 
-	LOG_DEBUG(">>>>>>>>>>>> setup records")
+	for hook, chain := range iptablesChains {
+		//链已存在时-N会失败，清空即可
+		if _, err := ExecCommand(exec.Command(iptables, "-N", chain)); err != nil {
+			if _, err = ExecCommand(exec.Command(iptables, "-F", chain)); err != nil {
+				return err
+			}
+		}
+
+		//插到最前面，保证在其他规则ACCEPT/DROP之前计数
+		jump := []string{hook, "-j", chain, "-m", "comment", "--comment", iptablesJumpTag}
+		if _, err := ExecCommand(exec.Command(iptables, append([]string{"-C"}, jump...)...)); err != nil {
+			if _, err = ExecCommand(exec.Command(iptables, append([]string{"-I"}, jump...)...)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, spec := range c.config.portsList {
 
-	portsList := server.portsList
-	for _, port := range portsList {
-		LOG_INFO_F("init iptables with port : %d", port)
+		LOG_INFO_F("init %s with port : %s", iptables, spec)
 
-		cmd1 := []*exec.Cmd{
-			exec.Command("iptables", "-A", "INPUT", "-p", "tcp", "--dport", fmt.Sprintf("%d", port)),
+		_, err := ExecCommand(exec.Command(iptables, "-A", iptablesInChain, "-p", spec.proto, "--dport", strconv.Itoa(spec.port),
+			"-m", "comment", "--comment", iptablesTag(spec, "in")))
+		if err != nil {
+			return err
 		}
-		ExecPipeLine(cmd1...)
 
-		cmd2 := []*exec.Cmd{
-			exec.Command("iptables", "-A", "OUTPUT", "-p", "tcp", "--sport", fmt.Sprintf("%d", port)),
+		_, err = ExecCommand(exec.Command(iptables, "-A", iptablesOutChain, "-p", spec.proto, "--sport", strconv.Itoa(spec.port),
+			"-m", "comment", "--comment", iptablesTag(spec, "out")))
+		if err != nil {
+			return err
 		}
-		ExecPipeLine(cmd2...)
 	}
+	return nil
 }
@@ -0,0 +1,501 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	afpacketInterfaces = flagSet.String("afpacket.interfaces", "", "interfaces the afpacket collector captures on, separated by comma, empty for all")
+	afpacketRing       = flagSet.Bool("afpacket.ring", false, "use a TPACKET_V3 mmap ring instead of recvfrom")
+	afpacketRingBlocks = flagSet.Int("afpacket.ringBlocks", 8, "1MB blocks of each TPACKET_V3 ring")
+)
+
+//通过AF_PACKET抓包按端口统计流量，只挂载BPF过滤器，不修改防火墙规则
+func init() {
+	RegisterCollector("afpacket", func(config *collectConfig) Collector {
+		return &afpacketCollector{config: config}
+	})
+}
+
+const (
+	ethPAll = 0x0003 //ETH_P_ALL
+
+	solPacket       = 263 //SOL_PACKET
+	packetRxRing    = 5   //PACKET_RX_RING
+	packetStats     = 6   //PACKET_STATISTICS
+	packetVersion   = 10  //PACKET_VERSION
+	tpacketV3       = 2   //TPACKET_V3
+	packetOutgoing  = 4   //PACKET_OUTGOING
+	tpStatusUser    = 1   //TP_STATUS_USER
+	tpStatusKernel  = 0   //TP_STATUS_KERNEL
+	soAttachFilter  = 26  //SO_ATTACH_FILTER
+	afpacketSnapLen = 256 //只需要报文头，ip长度取自报文头
+
+	afpacketBlockSize    = 1 << 20
+	afpacketFrameSize    = 1 << 11
+	afpacketBlockTimeout = 100 //ms，块未满时交给用户态的超时
+	afpacketPollTimeout  = 500 * time.Millisecond
+)
+
+//抓包的一个socket，绑定到一个接口或所有接口
+type afpacketSocket struct {
+	fd   int
+	name string
+	ring []byte
+
+	//PACKET_STATISTICS读取后清零，这里累加
+	packets uint64
+	drops   uint64
+}
+
+type afpacketCollector struct {
+	config   *collectConfig
+	agg      *flowAggregator
+	loopback map[int]bool //回环接口上同一个报文会收到发出和收到两份，丢弃发出的
+
+	mux     sync.Mutex //指标接口会并发读取sockets
+	sockets []*afpacketSocket
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (c *afpacketCollector) Setup() error {
+	filter, err := compilePortFilter(c.config.portsList, afpacketSnapLen)
+	if err != nil {
+		return err
+	}
+
+	c.agg = newFlowAggregator(c.config)
+	c.loopback = make(map[int]bool)
+	c.stop = make(chan struct{})
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]net.Interface)
+	for _, ifc := range interfaces {
+		byName[ifc.Name] = ifc
+		if ifc.Flags&net.FlagLoopback != 0 {
+			c.loopback[ifc.Index] = true
+		}
+	}
+
+	//不指定接口时绑定到0，即所有接口
+	targets := map[string]int{"all": 0}
+	if names := strings.TrimSpace(*afpacketInterfaces); names != "" {
+		targets = make(map[string]int)
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			ifc, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("afpacket interface[%s] not found", name)
+			}
+			targets[name] = ifc.Index
+		}
+	}
+
+	for name, index := range targets {
+		sock, err := openAfpacketSocket(name, index, filter, *afpacketRing, *afpacketRingBlocks)
+		if err != nil {
+			c.Teardown()
+			return fmt.Errorf("open afpacket socket on %s fail: %v", name, err)
+		}
+		c.mux.Lock()
+		c.sockets = append(c.sockets, sock)
+		c.mux.Unlock()
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			if sock.ring != nil {
+				c.readRing(sock)
+			} else {
+				c.readSocket(sock)
+			}
+		}()
+		LOG_INFO_F("afpacket collector capture on %s (ring: %v)", name, sock.ring != nil)
+	}
+	return nil
+}
+
+//先用协议0建socket并挂上过滤器再绑定，避免过滤器生效前收到无关的报文
+func openAfpacketSocket(name string, index int, filter []bpfInstruction, ring bool, blocks int) (*afpacketSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	sock := &afpacketSocket{fd: fd, name: name}
+
+	if err = attachFilter(fd, filter); err != nil {
+		sock.close()
+		return nil, err
+	}
+
+	if ring {
+		if err = sock.setupRing(blocks); err != nil {
+			sock.close()
+			return nil, err
+		}
+	} else {
+		//recvfrom阻塞时定期返回，以便检查退出
+		tv := syscall.NsecToTimeval(int64(afpacketPollTimeout))
+		if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			sock.close()
+			return nil, err
+		}
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: index})
+	if err != nil {
+		sock.close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+//struct sock_fprog
+type sockFprog struct {
+	length uint16
+	filter *bpfInstruction
+}
+
+func attachFilter(fd int, filter []bpfInstruction) error {
+	prog := sockFprog{length: uint16(len(filter)), filter: &filter[0]}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, soAttachFilter,
+		uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+//struct tpacket_req3
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+func (sock *afpacketSocket) setupRing(blocks int) error {
+	if blocks <= 0 {
+		blocks = 1
+	}
+	if err := syscall.SetsockoptInt(sock.fd, solPacket, packetVersion, tpacketV3); err != nil {
+		return err
+	}
+
+	req := tpacketReq3{
+		blockSize:    afpacketBlockSize,
+		blockNr:      uint32(blocks),
+		frameSize:    afpacketFrameSize,
+		frameNr:      uint32(blocks) * (afpacketBlockSize / afpacketFrameSize),
+		retireBlkTov: afpacketBlockTimeout,
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(sock.fd), solPacket, packetRxRing,
+		uintptr(unsafe.Pointer(&req)), unsafe.Sizeof(req), 0)
+	if errno != 0 {
+		return errno
+	}
+
+	ring, err := syscall.Mmap(sock.fd, 0, blocks*afpacketBlockSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	sock.ring = ring
+	return nil
+}
+
+func (sock *afpacketSocket) close() {
+	if sock.ring != nil {
+		_ = syscall.Munmap(sock.ring)
+		sock.ring = nil
+	}
+	if sock.fd >= 0 {
+		syscall.Close(sock.fd)
+		sock.fd = -1
+	}
+}
+
+//读取并累加内核的收包和丢包计数，tpacket_stats和tpacket_stats_v3的前两个字段相同
+func (sock *afpacketSocket) readStats() {
+	var stats [3]uint32
+	size := uint32(unsafe.Sizeof(stats))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(sock.fd), solPacket, packetStats,
+		uintptr(unsafe.Pointer(&stats[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return
+	}
+	atomic.AddUint64(&sock.packets, uint64(stats[0]))
+	atomic.AddUint64(&sock.drops, uint64(stats[1]))
+}
+
+func (c *afpacketCollector) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//统计一个报文，SOCK_DGRAM收到的数据从网络层开始
+func (c *afpacketCollector) count(data []byte, ifindex int, pkttype uint8) {
+	if pkttype == packetOutgoing && c.loopback[ifindex] {
+		return
+	}
+	info, ok := decodeIP(data)
+	if !ok {
+		return
+	}
+	c.agg.add(&decodedFlow{
+		srcPort: info.srcPort,
+		dstPort: info.dstPort,
+		proto:   info.proto,
+		family:  info.family,
+		bytes:   uint64(info.length),
+		packets: 1,
+	})
+}
+
+func (c *afpacketCollector) readSocket(sock *afpacketSocket) {
+	buf := make([]byte, afpacketSnapLen)
+	for !c.stopped() {
+		n, from, err := syscall.Recvfrom(sock.fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			LOG_ERROR_F("afpacket read on %s fail: %v", sock.name, err)
+			return
+		}
+		if sll, ok := from.(*syscall.SockaddrLinklayer); ok {
+			c.count(buf[:n], sll.Ifindex, sll.Pkttype)
+		}
+	}
+}
+
+//TPACKET_V3的块头和报文头中用到的字段偏移
+const (
+	tpBlockStatusOffset = 8  //tpacket_block_desc.hdr.bh1.block_status
+	tpNumPktsOffset     = 12 //num_pkts
+	tpFirstPktOffset    = 16 //offset_to_first_pkt
+	tpNextOffset        = 0  //tpacket3_hdr.tp_next_offset
+	tpSnapLenOffset     = 12 //tp_snaplen
+	tpNetOffset         = 26 //tp_net
+	tpSockaddrOffset    = 48 //TPACKET_ALIGN(sizeof(struct tpacket3_hdr))
+	sllIfindexOffset    = 4  //sockaddr_ll.sll_ifindex
+	sllPkttypeOffset    = 10 //sockaddr_ll.sll_pkttype
+)
+
+func (c *afpacketCollector) readRing(sock *afpacketSocket) {
+	blocks := len(sock.ring) / afpacketBlockSize
+	pollTimeout := syscall.NsecToTimespec(int64(afpacketPollTimeout))
+	for current := 0; !c.stopped(); {
+		block := sock.ring[current*afpacketBlockSize : (current+1)*afpacketBlockSize]
+		status := (*uint32)(unsafe.Pointer(&block[tpBlockStatusOffset]))
+		if atomic.LoadUint32(status)&tpStatusUser == 0 {
+			//struct pollfd {int fd; short events; short revents;}
+			pfd := struct {
+				fd      int32
+				events  int16
+				revents int16
+			}{fd: int32(sock.fd), events: 0x1} //POLLIN
+			_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1,
+				uintptr(unsafe.Pointer(&pollTimeout)), 0, 0, 0)
+			if errno != 0 && errno != syscall.EINTR {
+				LOG_ERROR_F("afpacket poll on %s fail: %v", sock.name, errno)
+				return
+			}
+			continue
+		}
+
+		numPkts := *(*uint32)(unsafe.Pointer(&block[tpNumPktsOffset]))
+		offset := *(*uint32)(unsafe.Pointer(&block[tpFirstPktOffset]))
+		for i := uint32(0); i < numPkts && int(offset) < len(block); i++ {
+			hdr := block[offset:]
+			snapLen := *(*uint32)(unsafe.Pointer(&hdr[tpSnapLenOffset]))
+			netOffset := *(*uint16)(unsafe.Pointer(&hdr[tpNetOffset]))
+			ifindex := *(*int32)(unsafe.Pointer(&hdr[tpSockaddrOffset+sllIfindexOffset]))
+			pkttype := hdr[tpSockaddrOffset+sllPkttypeOffset]
+			if end := int(netOffset) + int(snapLen); end <= len(hdr) {
+				c.count(hdr[netOffset:end], int(ifindex), pkttype)
+			}
+
+			next := *(*uint32)(unsafe.Pointer(&hdr[tpNextOffset]))
+			if next == 0 {
+				break
+			}
+			offset += next
+		}
+
+		//块交还给内核
+		atomic.StoreUint32(status, tpStatusKernel)
+		current = (current + 1) % blocks
+	}
+}
+
+func (c *afpacketCollector) Sample() (map[flowKey]*flowCounter, error) {
+	if c.agg == nil {
+		return nil, errors.New("afpacket collector is not setup")
+	}
+	c.mux.Lock()
+	for _, sock := range c.sockets {
+		sock.readStats()
+	}
+	c.mux.Unlock()
+	return c.agg.snapshot(), nil
+}
+
+func (c *afpacketCollector) Teardown() error {
+	if c.stop == nil {
+		return nil
+	}
+	close(c.stop)
+	c.wg.Wait()
+	c.mux.Lock()
+	for _, sock := range c.sockets {
+		sock.close()
+	}
+	c.sockets = nil
+	c.mux.Unlock()
+	c.stop = nil
+	return nil
+}
+
+//输出内核的收包和丢包计数
+func (c *afpacketCollector) writeMetrics(w *metricsWriter) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	w.header("netflow_afpacket_packets_total", "Packets passed the port filter, reported by the kernel.", "counter")
+	for _, sock := range c.sockets {
+		w.sample("netflow_afpacket_packets_total", float64(atomic.LoadUint64(&sock.packets)), "interface", sock.name)
+	}
+	w.header("netflow_afpacket_drops_total", "Packets dropped because the socket buffer or ring is full, reported by the kernel.", "counter")
+	for _, sock := range c.sockets {
+		w.sample("netflow_afpacket_drops_total", float64(atomic.LoadUint64(&sock.drops)), "interface", sock.name)
+	}
+}
+
+// ------------  BPF ---------------
+
+//struct sock_filter
+type bpfInstruction struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+//classic BPF指令
+const (
+	bpfLdB   = 0x30 //BPF_LD|BPF_B|BPF_ABS
+	bpfLdH   = 0x28 //BPF_LD|BPF_H|BPF_ABS
+	bpfLdHX  = 0x48 //BPF_LD|BPF_H|BPF_IND
+	bpfLdxB  = 0xb1 //BPF_LDX|BPF_B|BPF_MSH，X = 4*([k]&0xf)
+	bpfAndK  = 0x54 //BPF_ALU|BPF_AND|BPF_K
+	bpfJa    = 0x05 //BPF_JMP|BPF_JA
+	bpfJeqK  = 0x15 //BPF_JMP|BPF_JEQ|BPF_K
+	bpfJsetK = 0x45 //BPF_JMP|BPF_JSET|BPF_K
+	bpfRetK  = 0x06 //BPF_RET|BPF_K
+)
+
+//编译端口过滤器，SOCK_DGRAM下偏移0即ip头：
+//ipv4非首个分片丢弃，协议为tcp/udp/sctp且源或目的端口在列表中的保留前snapLen字节；
+//ipv6只匹配没有扩展头的报文。过滤器只做初筛，协议与端口的精确对应在统计时判断
+func compilePortFilter(portsList []portSpec, snapLen uint32) ([]bpfInstruction, error) {
+	var protos []uint32
+	var portNumbers []uint32
+	seenProto := make(map[uint32]bool)
+	seenPort := make(map[uint32]bool)
+	for _, spec := range portsList {
+		if proto := uint32(protoNumbers[spec.proto]); !seenProto[proto] {
+			seenProto[proto] = true
+			protos = append(protos, proto)
+		}
+		if port := uint32(spec.port); !seenPort[port] {
+			seenPort[port] = true
+			portNumbers = append(portNumbers, port)
+		}
+	}
+	if len(portNumbers) == 0 {
+		return nil, errors.New("no port to capture")
+	}
+
+	accept := bpfInstruction{code: bpfRetK, k: snapLen}
+	drop := bpfInstruction{code: bpfRetK, k: 0}
+
+	//协议匹配时跳过紧随其后的drop
+	matchProto := func(prog []bpfInstruction) []bpfInstruction {
+		for i, proto := range protos {
+			prog = append(prog, bpfInstruction{code: bpfJeqK, jt: uint8(len(protos) - i), k: proto})
+		}
+		return append(prog, drop)
+	}
+	//端口匹配时执行紧随其后的accept
+	matchPorts := func(prog []bpfInstruction) []bpfInstruction {
+		for _, port := range portNumbers {
+			prog = append(prog, bpfInstruction{code: bpfJeqK, jt: 0, jf: 1, k: port}, accept)
+		}
+		return prog
+	}
+
+	var v4 []bpfInstruction
+	v4 = append(v4, bpfInstruction{code: bpfLdH, k: 6}, bpfInstruction{code: bpfJsetK, jt: 0, jf: 1, k: 0x1fff}, drop)
+	v4 = append(v4, bpfInstruction{code: bpfLdB, k: 9})
+	v4 = matchProto(v4)
+	v4 = append(v4, bpfInstruction{code: bpfLdxB, k: 0})
+	v4 = append(v4, bpfInstruction{code: bpfLdHX, k: 0})
+	v4 = matchPorts(v4)
+	v4 = append(v4, bpfInstruction{code: bpfLdHX, k: 2})
+	v4 = matchPorts(v4)
+	v4 = append(v4, drop)
+
+	var v6 []bpfInstruction
+	v6 = append(v6, bpfInstruction{code: bpfLdB, k: 6})
+	v6 = matchProto(v6)
+	v6 = append(v6, bpfInstruction{code: bpfLdH, k: 40})
+	v6 = matchPorts(v6)
+	v6 = append(v6, bpfInstruction{code: bpfLdH, k: 42})
+	v6 = matchPorts(v6)
+	v6 = append(v6, drop)
+
+	//按ip版本分支，长跳转用ja
+	prog := []bpfInstruction{
+		{code: bpfLdB, k: 0},
+		{code: bpfAndK, k: 0xf0},
+		{code: bpfJeqK, jt: 0, jf: 1, k: 0x40},
+		{code: bpfJa, k: 3},
+		{code: bpfJeqK, jt: 0, jf: 1, k: 0x60},
+		{code: bpfJa, k: uint32(len(v4)) + 1},
+		drop,
+	}
+	prog = append(prog, v4...)
+	prog = append(prog, v6...)
+
+	//内核限制BPF_MAXINSNS
+	if len(prog) > 4096 {
+		return nil, fmt.Errorf("too many ports for the bpf filter (%d instructions)", len(prog))
+	}
+	return prog, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+//按内核的语义执行过滤器，越界读取时丢弃报文
+func runBPF(t *testing.T, prog []bpfInstruction, packet []byte) uint32 {
+	var a, x uint32
+	load := func(offset uint32, size int) (uint32, bool) {
+		if int(offset)+size > len(packet) {
+			return 0, false
+		}
+		if size == 1 {
+			return uint32(packet[offset]), true
+		}
+		return uint32(binary.BigEndian.Uint16(packet[offset:])), true
+	}
+
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		var ok bool
+		switch ins.code {
+		case bpfLdB:
+			if a, ok = load(ins.k, 1); !ok {
+				return 0
+			}
+		case bpfLdH:
+			if a, ok = load(ins.k, 2); !ok {
+				return 0
+			}
+		case bpfLdHX:
+			if a, ok = load(x+ins.k, 2); !ok {
+				return 0
+			}
+		case bpfLdxB:
+			if x, ok = load(ins.k, 1); !ok {
+				return 0
+			}
+			x = 4 * (x & 0xf)
+		case bpfAndK:
+			a &= ins.k
+		case bpfJa:
+			pc += int(ins.k)
+		case bpfJeqK:
+			if a == ins.k {
+				pc += int(ins.jt)
+			} else {
+				pc += int(ins.jf)
+			}
+		case bpfJsetK:
+			if a&ins.k != 0 {
+				pc += int(ins.jt)
+			} else {
+				pc += int(ins.jf)
+			}
+		case bpfRetK:
+			return ins.k
+		default:
+			t.Fatalf("unknown instruction %#x at %d", ins.code, pc)
+		}
+	}
+	t.Fatal("filter runs off the end")
+	return 0
+}
+
+//ipv4报文，ihl为头长度（4字节为单位），frag为标志和片偏移字段
+func bpfTestIPv4(proto uint8, ihl int, frag uint16, srcPort, dstPort uint16) []byte {
+	packet := make([]byte, ihl*4+8)
+	packet[0] = 0x40 | byte(ihl)
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[6:], frag)
+	packet[9] = proto
+	binary.BigEndian.PutUint16(packet[ihl*4:], srcPort)
+	binary.BigEndian.PutUint16(packet[ihl*4+2:], dstPort)
+	return packet
+}
+
+func bpfTestIPv6(next uint8, srcPort, dstPort uint16) []byte {
+	packet := make([]byte, 48)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], 8)
+	packet[6] = next
+	binary.BigEndian.PutUint16(packet[40:], srcPort)
+	binary.BigEndian.PutUint16(packet[42:], dstPort)
+	return packet
+}
+
+func TestCompilePortFilter(t *testing.T) {
+	const snapLen = 128
+	prog, err := compilePortFilter([]portSpec{{proto: "tcp", port: 8080}, {proto: "udp", port: 53}, {proto: "tcp", port: 53}}, snapLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//端口按ihl定位，选项中的8080不算
+	options := bpfTestIPv4(6, 7, 0, 1234, 5678)
+	binary.BigEndian.PutUint16(options[22:], 8080)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		accept bool
+	}{
+		{"v4 tcp dport", bpfTestIPv4(6, 5, 0, 40000, 8080), true},
+		{"v4 tcp sport", bpfTestIPv4(6, 5, 0, 8080, 40000), true},
+		{"v4 udp dport", bpfTestIPv4(17, 5, 0, 5353, 53), true},
+		{"v4 udp sport", bpfTestIPv4(17, 5, 0, 53, 5353), true},
+		//只做初筛，udp/8080由统计时排除
+		{"v4 udp other listed port", bpfTestIPv4(17, 5, 0, 5353, 8080), true},
+		{"v4 tcp other port", bpfTestIPv4(6, 5, 0, 1234, 5678), false},
+		{"v4 sctp", bpfTestIPv4(132, 5, 0, 40000, 8080), false},
+		{"v4 icmp", bpfTestIPv4(1, 5, 0, 40000, 8080), false},
+		{"v4 options", bpfTestIPv4(6, 7, 0, 40000, 8080), true},
+		{"v4 options other port", options, false},
+		{"v4 options truncated", bpfTestIPv4(6, 7, 0, 40000, 8080)[:28], false},
+		{"v4 first fragment", bpfTestIPv4(6, 5, 0x2000, 40000, 8080), true},
+		{"v4 non-first fragment", bpfTestIPv4(6, 5, 0x2000|185, 40000, 8080), false},
+		{"v4 last fragment", bpfTestIPv4(6, 5, 185, 40000, 8080), false},
+		{"v6 tcp dport", bpfTestIPv6(6, 40000, 8080), true},
+		{"v6 udp sport", bpfTestIPv6(17, 53, 5353), true},
+		{"v6 tcp other port", bpfTestIPv6(6, 1234, 5678), false},
+		{"v6 sctp", bpfTestIPv6(132, 40000, 8080), false},
+		//扩展头之后的端口位置不固定，分片也在扩展头中
+		{"v6 fragment header", bpfTestIPv6(44, 40000, 8080), false},
+		{"v6 truncated", bpfTestIPv6(6, 40000, 8080)[:41], false},
+		{"not ip", append([]byte{0x50}, bpfTestIPv4(6, 5, 0, 40000, 8080)[1:]...), false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		want := uint32(0)
+		if test.accept {
+			want = snapLen
+		}
+		if got := runBPF(t, prog, test.packet); got != want {
+			t.Errorf("%s: filter returns %d, want %d", test.name, got, want)
+		}
+	}
+
+	if _, err := compilePortFilter(nil, snapLen); err == nil {
+		t.Error("empty ports list should fail")
+	}
+	var many []portSpec
+	for port := 1; port <= 2100; port++ {
+		many = append(many, portSpec{proto: "tcp", port: port})
+	}
+	if _, err := compilePortFilter(many, snapLen); err == nil {
+		t.Error("filter over BPF_MAXINSNS should fail")
+	}
+}
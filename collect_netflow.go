@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	netflowListen = flagSet.String("netflow.listen", ":2055", "udp address the netflow collector listens on for v5/v9/ipfix")
+)
+
+func init() {
+	RegisterCollector("netflow", func(config *collectConfig) Collector {
+		return &netflowCollector{config: config}
+	})
+}
+
+// ------------  流量汇总 ---------------
+
+//从流记录中解出的一条流
+type decodedFlow struct {
+	srcPort uint16
+	dstPort uint16
+	proto   uint8
+	family  int
+	bytes   uint64
+	packets uint64
+}
+
+//把收到的流按端口累加：目的端口为监控端口的计入入站，源端口为监控端口的计入出站，
+//与iptables后端 --dport/--sport 的口径一致
+type flowAggregator struct {
+	mux      sync.Mutex
+	ports    map[portSpec]bool
+	families map[int]bool
+	counters map[flowKey]*flowCounter
+}
+
+func newFlowAggregator(config *collectConfig) *flowAggregator {
+	agg := &flowAggregator{
+		ports:    make(map[portSpec]bool),
+		families: make(map[int]bool),
+		counters: make(map[flowKey]*flowCounter),
+	}
+	for _, spec := range config.portsList {
+		agg.ports[spec] = true
+	}
+	for _, family := range config.families {
+		agg.families[family] = true
+	}
+	//没有收到流的端口也返回0，保持各端口的采样窗口一致
+	for _, key := range config.flowKeys() {
+		agg.counters[key] = &flowCounter{}
+	}
+	return agg
+}
+
+func (agg *flowAggregator) add(flow *decodedFlow) {
+	proto := protoName(flow.proto)
+	if proto == "" || !agg.families[flow.family] {
+		return
+	}
+
+	agg.mux.Lock()
+	defer agg.mux.Unlock()
+
+	if spec := (portSpec{proto: proto, port: int(flow.dstPort)}); agg.ports[spec] {
+		counter := agg.counter(flowKey{portSpec: spec, family: flow.family})
+		counter.inFlow += int64(flow.bytes)
+		counter.inPackets += int64(flow.packets)
+	}
+	if spec := (portSpec{proto: proto, port: int(flow.srcPort)}); agg.ports[spec] {
+		counter := agg.counter(flowKey{portSpec: spec, family: flow.family})
+		counter.outFlow += int64(flow.bytes)
+		counter.outPackets += int64(flow.packets)
+	}
+}
+
+func (agg *flowAggregator) counter(key flowKey) *flowCounter {
+	counter, ok := agg.counters[key]
+	if !ok {
+		counter = &flowCounter{}
+		agg.counters[key] = counter
+	}
+	return counter
+}
+
+//当前的累计计数，返回副本
+func (agg *flowAggregator) snapshot() map[flowKey]*flowCounter {
+	agg.mux.Lock()
+	defer agg.mux.Unlock()
+
+	counters := make(map[flowKey]*flowCounter, len(agg.counters))
+	for key, counter := range agg.counters {
+		c := *counter
+		counters[key] = &c
+	}
+	return counters
+}
+
+//循环读取udp报文直到连接关闭
+func serveUDP(conn *net.UDPConn, handle func(from string, data []byte)) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			LOG_ERROR(err)
+			continue
+		}
+		handle(addr.IP.String(), buf[:n])
+	}
+}
+
+// ------------  netflow采集后端 ---------------
+
+//作为netflow/ipfix收集器，接收路由器等设备发来的流记录并按端口汇总
+type netflowCollector struct {
+	config  *collectConfig
+	conn    *net.UDPConn
+	done    chan struct{}
+	agg     *flowAggregator
+	decoder *netflowDecoder
+
+	packets      uint64
+	decodeErrors uint64
+}
+
+func (c *netflowCollector) Setup() error {
+	addr, err := net.ResolveUDPAddr("udp", *netflowListen)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.done = make(chan struct{})
+	c.agg = newFlowAggregator(c.config)
+	c.decoder = newNetflowDecoder()
+	LOG_INFO_F("netflow collector listen on %s", conn.LocalAddr())
+
+	go func() {
+		defer close(c.done)
+		serveUDP(conn, c.handle)
+	}()
+	return nil
+}
+
+func (c *netflowCollector) handle(from string, data []byte) {
+	atomic.AddUint64(&c.packets, 1)
+	if err := c.decoder.decode(from, data, c.agg.add); err != nil {
+		if atomic.AddUint64(&c.decodeErrors, 1)%100 == 1 {
+			LOG_WARN_F("decode netflow packet from %s fail: %v (errors %d)", from, err, atomic.LoadUint64(&c.decodeErrors))
+		}
+	}
+}
+
+func (c *netflowCollector) Sample() (map[flowKey]*flowCounter, error) {
+	if c.agg == nil {
+		return nil, errors.New("netflow collector is not setup")
+	}
+	return c.agg.snapshot(), nil
+}
+
+func (c *netflowCollector) Teardown() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	<-c.done
+	c.conn = nil
+	return err
+}
+
+// ------------  netflow解码 ---------------
+
+//模板按 设备地址+版本+source id/observation domain+模板id 缓存
+type netflowTemplateKey struct {
+	exporter string
+	version  uint16
+	domain   uint32
+	id       uint16
+}
+
+//缓存的模板，options模板只记录id，数据直接跳过
+type netflowTemplate struct {
+	fields  []netflowField
+	options bool
+}
+
+type netflowDecoder struct {
+	mux       sync.Mutex
+	templates map[netflowTemplateKey]*netflowTemplate
+}
+
+func newNetflowDecoder() *netflowDecoder {
+	return &netflowDecoder{templates: make(map[netflowTemplateKey]*netflowTemplate)}
+}
+
+var errNetflowShort = errors.New("packet too short")
+
+//解码一个报文，每条流交给emit
+func (d *netflowDecoder) decode(exporter string, data []byte, emit func(*decodedFlow)) error {
+	if len(data) < 2 {
+		return errNetflowShort
+	}
+	switch version := binary.BigEndian.Uint16(data); version {
+	case netflowV5:
+		return decodeNetflowV5(data, emit)
+	case netflowV9:
+		if len(data) < netflowV9HeaderLen {
+			return errNetflowShort
+		}
+		domain := binary.BigEndian.Uint32(data[16:])
+		return d.decodeSets(exporter, version, domain, data[netflowV9HeaderLen:], emit)
+	case ipfixV10:
+		if len(data) < ipfixHeaderLen {
+			return errNetflowShort
+		}
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < ipfixHeaderLen || length > len(data) {
+			return fmt.Errorf("bad ipfix message length %d", length)
+		}
+		domain := binary.BigEndian.Uint32(data[12:])
+		return d.decodeSets(exporter, version, domain, data[ipfixHeaderLen:length], emit)
+	default:
+		return fmt.Errorf("unsupported netflow version %d", version)
+	}
+}
+
+//v5为固定格式，头中带有采样间隔
+func decodeNetflowV5(data []byte, emit func(*decodedFlow)) error {
+	if len(data) < netflowV5HeaderLen {
+		return errNetflowShort
+	}
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < netflowV5HeaderLen+count*netflowV5RecordLen {
+		return errNetflowShort
+	}
+	//高2位为采样模式，低14位为采样间隔
+	sampling := uint64(binary.BigEndian.Uint16(data[22:]) & 0x3fff)
+	if sampling == 0 {
+		sampling = 1
+	}
+
+	for i := 0; i < count; i++ {
+		r := data[netflowV5HeaderLen+i*netflowV5RecordLen:]
+		emit(&decodedFlow{
+			packets: uint64(binary.BigEndian.Uint32(r[16:])) * sampling,
+			bytes:   uint64(binary.BigEndian.Uint32(r[20:])) * sampling,
+			srcPort: binary.BigEndian.Uint16(r[32:]),
+			dstPort: binary.BigEndian.Uint16(r[34:]),
+			proto:   r[38],
+			family:  familyIPv4,
+		})
+	}
+	return nil
+}
+
+//遍历v9的flowset或ipfix的set
+func (d *netflowDecoder) decodeSets(exporter string, version uint16, domain uint32, data []byte, emit func(*decodedFlow)) error {
+	templateSetID, optionsSetID := uint16(netflowV9TemplateSetID), uint16(netflowV9OptionsSetID)
+	if version == ipfixV10 {
+		templateSetID, optionsSetID = ipfixTemplateSetID, ipfixOptionsSetID
+	}
+
+	for len(data) >= 4 {
+		setID := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < 4 || length > len(data) {
+			return fmt.Errorf("bad set length %d", length)
+		}
+		body := data[4:length]
+		data = data[length:]
+
+		key := netflowTemplateKey{exporter: exporter, version: version, domain: domain}
+		var err error
+		switch {
+		case setID == templateSetID:
+			err = d.parseTemplates(key, body)
+		case setID == optionsSetID:
+			err = d.parseOptionsTemplates(key, body)
+		case setID >= netflowMinDataSetID:
+			key.id = setID
+			err = d.decodeData(key, body, emit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *netflowDecoder) parseTemplates(key netflowTemplateKey, data []byte) error {
+	for len(data) >= 4 {
+		key.id = binary.BigEndian.Uint16(data)
+		count := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+
+		//ipfix中字段数为0表示撤回模板
+		if count == 0 {
+			d.mux.Lock()
+			delete(d.templates, key)
+			d.mux.Unlock()
+			continue
+		}
+
+		fields, rest, err := parseTemplateFields(key.version, data, count)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		d.mux.Lock()
+		d.templates[key] = &netflowTemplate{fields: fields}
+		d.mux.Unlock()
+	}
+	return nil
+}
+
+//options模板只用于跳过对应的数据
+func (d *netflowDecoder) parseOptionsTemplates(key netflowTemplateKey, data []byte) error {
+	for len(data) >= 6 {
+		key.id = binary.BigEndian.Uint16(data)
+		var count int
+		if key.version == ipfixV10 {
+			//模板id、字段总数、scope字段数
+			count = int(binary.BigEndian.Uint16(data[2:]))
+		} else {
+			//模板id、scope长度、option长度，单位字节
+			count = int(binary.BigEndian.Uint16(data[2:])+binary.BigEndian.Uint16(data[4:])) / 4
+		}
+		data = data[6:]
+
+		_, rest, err := parseTemplateFields(key.version, data, count)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		d.mux.Lock()
+		d.templates[key] = &netflowTemplate{options: true}
+		d.mux.Unlock()
+	}
+	return nil
+}
+
+//ipfix中类型最高位为1的是企业字段，后面跟4字节企业编号
+func parseTemplateFields(version uint16, data []byte, count int) ([]netflowField, []byte, error) {
+	fields := make([]netflowField, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < 4 {
+			return nil, nil, errors.New("template too short")
+		}
+		field := netflowField{
+			fieldType: binary.BigEndian.Uint16(data),
+			length:    binary.BigEndian.Uint16(data[2:]),
+		}
+		data = data[4:]
+		if version == ipfixV10 && field.fieldType&0x8000 != 0 {
+			if len(data) < 4 {
+				return nil, nil, errors.New("template too short")
+			}
+			data = data[4:]
+		}
+		fields = append(fields, field)
+	}
+	return fields, data, nil
+}
+
+//按模板解码数据记录，没有模板的数据丢弃
+func (d *netflowDecoder) decodeData(key netflowTemplateKey, data []byte, emit func(*decodedFlow)) error {
+	d.mux.Lock()
+	template, ok := d.templates[key]
+	d.mux.Unlock()
+	if !ok {
+		return fmt.Errorf("no template %d from %s domain %d", key.id, key.exporter, key.domain)
+	}
+	if template.options {
+		return nil
+	}
+
+	minLen := 0
+	for _, field := range template.fields {
+		if field.length != 0xffff {
+			minLen += int(field.length)
+		} else {
+			minLen++
+		}
+	}
+	if minLen == 0 {
+		return nil
+	}
+
+	//剩余不足一条记录的为填充
+	for len(data) >= minLen {
+		flow := &decodedFlow{family: familyIPv4}
+		sampling := uint64(1)
+		for _, field := range template.fields {
+			length := int(field.length)
+			//ipfix变长字段：1字节长度，为255时后跟2字节长度
+			if field.length == 0xffff {
+				if len(data) < 1 {
+					return errNetflowShort
+				}
+				length, data = int(data[0]), data[1:]
+				if length == 255 {
+					if len(data) < 2 {
+						return errNetflowShort
+					}
+					length, data = int(binary.BigEndian.Uint16(data)), data[2:]
+				}
+			}
+			if len(data) < length {
+				return errNetflowShort
+			}
+			value := data[:length]
+			data = data[length:]
+
+			switch field.fieldType {
+			case fieldInBytes:
+				flow.bytes = netflowUint(value)
+			case fieldInPkts:
+				flow.packets = netflowUint(value)
+			case fieldProtocol:
+				flow.proto = uint8(netflowUint(value))
+			case fieldL4SrcPort:
+				flow.srcPort = uint16(netflowUint(value))
+			case fieldL4DstPort:
+				flow.dstPort = uint16(netflowUint(value))
+			case fieldIPv6SrcAddr, fieldIPv6DstAddr:
+				flow.family = familyIPv6
+			case fieldIPVersion:
+				if netflowUint(value) == 6 {
+					flow.family = familyIPv6
+				}
+			case fieldSamplingInterval, fieldSamplingPacketInterval:
+				if s := netflowUint(value); s > 1 {
+					sampling = s
+				}
+			}
+		}
+		flow.bytes *= sampling
+		flow.packets *= sampling
+		emit(flow)
+	}
+	return nil
+}
+
+//大端无符号整数，长度可以是1~8字节
+func netflowUint(value []byte) uint64 {
+	var n uint64
+	for _, b := range value {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var testNetflowConfig = &collectConfig{
+	portsList: []portSpec{{proto: "tcp", port: 8080}, {proto: "udp", port: 53}},
+	families:  []int{familyIPv4, familyIPv6},
+}
+
+//用导出端的编码器生成报文
+func encodeTestNetflow(version int, records []*netflowRecord) (*netflowSink, [][]byte) {
+	sink := &netflowSink{version: version, domain: 7, bootTime: time.Now(), templateRefresh: time.Hour}
+	switch version {
+	case netflowV5:
+		return sink, sink.encodeV5(records)
+	case netflowV9:
+		return sink, sink.encodeTemplated(records, netflowV9Fields)
+	}
+	return sink, sink.encodeTemplated(records, ipfixFields)
+}
+
+func testNetflowRecords() []*netflowRecord {
+	return []*netflowRecord{
+		{dstPort: 8080, proto: protoNumbers["tcp"], direction: netflowDirectionIngress, bytes: 1000, packets: 10},
+		{srcPort: 8080, proto: protoNumbers["tcp"], direction: netflowDirectionEgress, bytes: 5000, packets: 8},
+		{dstPort: 53, proto: protoNumbers["udp"], direction: netflowDirectionIngress, bytes: 120, packets: 2},
+		//不监控的端口和协议
+		{dstPort: 9090, proto: protoNumbers["tcp"], direction: netflowDirectionIngress, bytes: 77, packets: 1},
+		{dstPort: 8080, proto: protoNumbers["udp"], direction: netflowDirectionIngress, bytes: 66, packets: 1},
+	}
+}
+
+func checkCounter(t *testing.T, name string, counters map[flowKey]*flowCounter, key flowKey, want flowCounter) {
+	t.Helper()
+	if got := counters[key]; got == nil || *got != want {
+		t.Errorf("%s: counter of %s (%s) = %+v, want %+v", name, key.portSpec, familyNames[key.family], got, want)
+	}
+}
+
+func TestNetflowDecodeVersions(t *testing.T) {
+	for _, version := range []int{netflowV5, netflowV9, ipfixV10} {
+		_, packets := encodeTestNetflow(version, testNetflowRecords())
+		if len(packets) != 1 {
+			t.Fatalf("v%d: %d packets, want 1", version, len(packets))
+		}
+
+		agg := newFlowAggregator(testNetflowConfig)
+		decoder := newNetflowDecoder()
+		//重复发送，计数累加
+		for i := 0; i < 2; i++ {
+			if err := decoder.decode("192.0.2.1", packets[0], agg.add); err != nil {
+				t.Fatalf("v%d: %v", version, err)
+			}
+		}
+
+		counters := agg.snapshot()
+		if len(counters) != 4 {
+			t.Errorf("v%d: %d counters, want 4", version, len(counters))
+		}
+		checkCounter(t, "tcp", counters, flowKey{portSpec{"tcp", 8080}, familyIPv4}, flowCounter{inFlow: 2000, inPackets: 20, outFlow: 10000, outPackets: 16})
+		checkCounter(t, "udp", counters, flowKey{portSpec{"udp", 53}, familyIPv4}, flowCounter{inFlow: 240, inPackets: 4})
+		checkCounter(t, "ipv6", counters, flowKey{portSpec{"tcp", 8080}, familyIPv6}, flowCounter{})
+	}
+}
+
+func TestNetflowDataBeforeTemplate(t *testing.T) {
+	for _, version := range []int{netflowV9, ipfixV10} {
+		sink, packets := encodeTestNetflow(version, nil)
+		template := packets[0]
+		var fields []netflowField
+		if version == netflowV9 {
+			fields = netflowV9Fields
+		} else {
+			fields = ipfixFields
+		}
+		//模板刚发过，这次只有数据
+		data := sink.encodeTemplated(testNetflowRecords(), fields)[0]
+
+		agg := newFlowAggregator(testNetflowConfig)
+		decoder := newNetflowDecoder()
+
+		//模板之前的数据丢弃，不缓存
+		if err := decoder.decode("192.0.2.1", data, agg.add); err == nil {
+			t.Errorf("v%d: data before template accepted", version)
+		}
+		checkCounter(t, "before template", agg.snapshot(), flowKey{portSpec{"tcp", 8080}, familyIPv4}, flowCounter{})
+
+		if err := decoder.decode("192.0.2.1", template, agg.add); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		//模板按设备缓存，其他设备的数据仍然没有模板
+		if err := decoder.decode("192.0.2.2", data, agg.add); err == nil {
+			t.Errorf("v%d: template of another exporter used", version)
+		}
+		if err := decoder.decode("192.0.2.1", data, agg.add); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		checkCounter(t, "after template", agg.snapshot(), flowKey{portSpec{"tcp", 8080}, familyIPv4}, flowCounter{inFlow: 1000, inPackets: 10, outFlow: 5000, outPackets: 8})
+	}
+}
+
+//设备发来的ipfix：带options模板、企业字段、变长字段、ipv6和采样间隔
+func TestNetflowDecodeIPFIXFields(t *testing.T) {
+	var sets []byte
+	//options模板300：1个scope字段
+	sets = appendUint16(sets, ipfixOptionsSetID, 4+6+8)
+	sets = appendUint16(sets, 300, 2, 1, 149, 4, 305, 4)
+	//数据模板400：企业字段、变长字段、源端口、目的端口、协议、ipv6源地址、字节、包数、采样间隔
+	template := appendUint16(nil, 400, 9)
+	template = appendUint16(template, 0x8000|100, 4)
+	template = binary.BigEndian.AppendUint32(template, 29305)
+	template = appendUint16(template, 82, 0xffff, fieldL4SrcPort, 2, fieldL4DstPort, 2, fieldProtocol, 1,
+		fieldIPv6SrcAddr, 16, fieldInBytes, 4, fieldInPkts, 4, fieldSamplingPacketInterval, 4)
+	sets = appendUint16(sets, ipfixTemplateSetID, uint16(4+len(template)))
+	sets = append(sets, template...)
+	//options数据
+	sets = appendUint16(sets, 300, 4+8)
+	sets = binary.BigEndian.AppendUint32(sets, 1)
+	sets = binary.BigEndian.AppendUint32(sets, 100)
+	//数据：两条记录，变长字段分别为短格式和长格式
+	var records []byte
+	for i, name := range []string{"eth0", string(make([]byte, 300))} {
+		records = binary.BigEndian.AppendUint32(records, 0xdeadbeef)
+		if len(name) < 255 {
+			records = append(records, byte(len(name)))
+		} else {
+			records = append(records, 255)
+			records = appendUint16(records, uint16(len(name)))
+		}
+		records = append(records, name...)
+		records = appendUint16(records, 40000+uint16(i), 8080)
+		records = append(records, protoNumbers["tcp"])
+		records = append(records, net.ParseIP("2001:db8::1")...)
+		records = binary.BigEndian.AppendUint32(records, 1500)
+		records = binary.BigEndian.AppendUint32(records, 1)
+		records = binary.BigEndian.AppendUint32(records, 10)
+	}
+	sets = appendUint16(sets, 400, uint16(4+len(records)))
+	sets = append(sets, records...)
+
+	packet := appendUint16(nil, ipfixV10, uint16(ipfixHeaderLen+len(sets)))
+	packet = binary.BigEndian.AppendUint32(packet, uint32(time.Now().Unix()))
+	packet = binary.BigEndian.AppendUint32(packet, 1)
+	packet = binary.BigEndian.AppendUint32(packet, 7)
+	packet = append(packet, sets...)
+
+	agg := newFlowAggregator(testNetflowConfig)
+	if err := newNetflowDecoder().decode("192.0.2.1", packet, agg.add); err != nil {
+		t.Fatal(err)
+	}
+	//按采样间隔放大
+	checkCounter(t, "ipfix", agg.snapshot(), flowKey{portSpec{"tcp", 8080}, familyIPv6}, flowCounter{inFlow: 30000, inPackets: 20})
+}
+
+func TestFlowAggregator(t *testing.T) {
+	config := &collectConfig{
+		portsList: []portSpec{{proto: "tcp", port: 8080}, {proto: "tcp", port: 443}},
+		families:  []int{familyIPv4},
+	}
+	agg := newFlowAggregator(config)
+	flows := []*decodedFlow{
+		{srcPort: 40000, dstPort: 8080, proto: 6, family: familyIPv4, bytes: 100, packets: 1},
+		{srcPort: 8080, dstPort: 40000, proto: 6, family: familyIPv4, bytes: 900, packets: 3},
+		//两端都是监控端口：8080入站，443出站
+		{srcPort: 443, dstPort: 8080, proto: 6, family: familyIPv4, bytes: 50, packets: 1},
+		//不采集的地址族和协议
+		{srcPort: 40000, dstPort: 8080, proto: 6, family: familyIPv6, bytes: 1000, packets: 1},
+		{srcPort: 40000, dstPort: 8080, proto: 17, family: familyIPv4, bytes: 1000, packets: 1},
+		{srcPort: 40000, dstPort: 8080, proto: 250, family: familyIPv4, bytes: 1000, packets: 1},
+	}
+	for _, flow := range flows {
+		agg.add(flow)
+	}
+
+	counters := agg.snapshot()
+	checkCounter(t, "8080", counters, flowKey{portSpec{"tcp", 8080}, familyIPv4}, flowCounter{inFlow: 150, inPackets: 2, outFlow: 900, outPackets: 3})
+	checkCounter(t, "443", counters, flowKey{portSpec{"tcp", 443}, familyIPv4}, flowCounter{outFlow: 50, outPackets: 1})
+	if len(counters) != 2 {
+		t.Errorf("%d counters, want 2", len(counters))
+	}
+
+	//快照是副本
+	counters[flowKey{portSpec{"tcp", 443}, familyIPv4}].outFlow = 0
+	checkCounter(t, "snapshot", agg.snapshot(), flowKey{portSpec{"tcp", 443}, familyIPv4}, flowCounter{outFlow: 50, outPackets: 1})
+}
+
+//向本机的收集器重放报文
+func TestNetflowCollectorReplay(t *testing.T) {
+	old := *netflowListen
+	*netflowListen = "127.0.0.1:0"
+	defer func() { *netflowListen = old }()
+
+	collector := &netflowCollector{config: testNetflowConfig}
+	if err := collector.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Teardown()
+
+	conn, err := net.DialUDP("udp", nil, collector.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, version := range []int{netflowV5, netflowV9, ipfixV10} {
+		_, packets := encodeTestNetflow(version, testNetflowRecords())
+		for _, packet := range packets {
+			if _, err := conn.Write(packet); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	want := flowCounter{inFlow: 3000, inPackets: 30, outFlow: 15000, outPackets: 24}
+	key := flowKey{portSpec{"tcp", 8080}, familyIPv4}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		counters, err := collector.Sample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *counters[key] == want {
+			return
+		}
+	}
+	counters, _ := collector.Sample()
+	t.Errorf("replayed counter = %+v, want %+v", counters[key], want)
+}
@@ -0,0 +1,138 @@
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+//nftables下使用的表，所有规则和计数器都放在这张表里，清理时整表删除
+const (
+	nftFamily = "inet"
+	nftTable  = "netflow"
+)
+
+//基于nftables命名计数器的采集后端
+type nftablesCollector struct {
+	config *collectConfig
+}
+
+func init() {
+	RegisterCollector("nftables", func(config *collectConfig) Collector {
+		return &nftablesCollector{config: config}
+	})
+}
+
+//计数器名，如 in_udp_53_ipv6
+func nftCounterName(direction string, key flowKey) string {
+	return direction + "_" + key.proto + "_" + strconv.Itoa(key.port) + "_" + familyNames[key.family]
+}
+
+//生成建表脚本，inet表同时处理ipv4和ipv6，按nfproto区分地址族
+func (c *nftablesCollector) ruleset() string {
+	var counters, input, output bytes.Buffer
+	for _, key := range c.config.flowKeys() {
+		inName := nftCounterName("in", key)
+		outName := nftCounterName("out", key)
+		nfproto := familyNames[key.family]
+		fmt.Fprintf(&counters, "\tcounter %s {}\n\tcounter %s {}\n", inName, outName)
+		fmt.Fprintf(&input, "\t\tmeta nfproto %s %s dport %d counter name \"%s\"\n", nfproto, key.proto, key.port, inName)
+		fmt.Fprintf(&output, "\t\tmeta nfproto %s %s sport %d counter name \"%s\"\n", nfproto, key.proto, key.port, outName)
+	}
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "table %s %s {\n", nftFamily, nftTable)
+	script.Write(counters.Bytes())
+	script.WriteString("\tchain input {\n\t\ttype filter hook input priority 0; policy accept;\n")
+	script.Write(input.Bytes())
+	script.WriteString("\t}\n\tchain output {\n\t\ttype filter hook output priority 0; policy accept;\n")
+	script.Write(output.Bytes())
+	script.WriteString("\t}\n}\n")
+	return script.String()
+}
+
+func (c *nftablesCollector) Setup() error {
+
+	LOG_DEBUG(">>>>>>>>>>>> setup nftables records")
+
+	//避免上次异常退出残留的表
+	c.Teardown()
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(c.ruleset())
+	_, err := ExecCommand(cmd)
+	return err
+}
+
+//nft -j输出中的计数器对象
+type nftCounter struct {
+	Family  string `json:"family"`
+	Name    string `json:"name"`
+	Table   string `json:"table"`
+	Packets int64  `json:"packets"`
+	Bytes   int64  `json:"bytes"`
+}
+
+func (c *nftablesCollector) Sample() (map[flowKey]*flowCounter, error) {
+
+	//一次列出整张表，拿到所有计数器
+	data, err := ExecCommand(exec.Command("nft", "-j", "list", "table", nftFamily, nftTable))
+	if err != nil {
+		return nil, err
+	}
+	return nftablesCounters(data, c.config.flowKeys())
+}
+
+//从nft -j的输出中按计数器名取出各端口的计数
+func nftablesCounters(data string, keys []flowKey) (map[flowKey]*flowCounter, error) {
+	var ruleset struct {
+		Nftables []struct {
+			Counter *nftCounter `json:"counter"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal([]byte(data), &ruleset); err != nil {
+		return nil, err
+	}
+
+	named := make(map[string]*ruleCounter)
+	for _, object := range ruleset.Nftables {
+		if object.Counter != nil && object.Counter.Table == nftTable {
+			named[object.Counter.Name] = &ruleCounter{
+				packets: object.Counter.Packets,
+				bytes:   object.Counter.Bytes,
+			}
+		}
+	}
+
+	counters := make(map[flowKey]*flowCounter, len(keys))
+	for _, key := range keys {
+		inFlow := named[nftCounterName("in", key)]
+		outFlow := named[nftCounterName("out", key)]
+		if inFlow == nil && outFlow == nil {
+			LOG_ERROR_F("nftables counter of port %s (%s) not found", key.portSpec, familyNames[key.family])
+			continue
+		}
+		counter := newFlowCounter(inFlow, outFlow)
+		if counter.missing() {
+			LOG_ERROR_F("nftables %s counter of port %s (%s) not found", counter.missingNames(), key.portSpec, familyNames[key.family])
+		}
+		counters[key] = counter
+	}
+	return counters, nil
+}
+
+func (c *nftablesCollector) Teardown() error {
+
+	LOG_DEBUG(">>>>>>>>>>>> clean nftables records")
+
+	//表不存在时nft会报错，这里不当作失败
+	if _, err := ExecCommand(exec.Command("nft", "delete", "table", nftFamily, nftTable)); err != nil {
+		LOG_DEBUG(err)
+	}
+	return nil
+}
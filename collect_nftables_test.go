@@ -0,0 +1,65 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+var testNftablesConfig = &collectConfig{
+	portsList: []portSpec{{proto: "tcp", port: 8080}, {proto: "udp", port: 53}, {proto: "sctp", port: 3868}},
+	families:  []int{familyIPv4, familyIPv6},
+}
+
+func TestNftablesRuleset(t *testing.T) {
+	want, err := ioutil.ReadFile("testdata/nftables-ruleset.nft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &nftablesCollector{config: testNftablesConfig}
+	if script := c.ruleset(); script != string(want) {
+		t.Errorf("ruleset =\n%s\nwant\n%s", script, want)
+	}
+}
+
+func TestNftablesCounters(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/nft-list-table.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters, err := nftablesCounters(string(data), testNftablesConfig.flowKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key     flowKey
+		found   bool
+		counter flowCounter
+	}{
+		{flowKey{portSpec{"tcp", 8080}, familyIPv4}, true, flowCounter{inFlow: 98000, outFlow: 1520000, inPackets: 120, outPackets: 110}},
+		{flowKey{portSpec{"tcp", 8080}, familyIPv6}, true, flowCounter{inFlow: 240, outFlow: 180, inPackets: 3, outPackets: 2}},
+		//只有入站计数器
+		{flowKey{portSpec{"udp", 53}, familyIPv4}, true, flowCounter{inFlow: 2600, inPackets: 40, outMissing: true}},
+		{flowKey{portSpec{"udp", 53}, familyIPv6}, false, flowCounter{}},
+		{flowKey{portSpec{"sctp", 3868}, familyIPv4}, false, flowCounter{}},
+	}
+	for _, test := range tests {
+		counter, ok := counters[test.key]
+		if ok != test.found {
+			t.Errorf("%s %s found = %v", test.key.portSpec, familyNames[test.key.family], ok)
+			continue
+		}
+		if ok && *counter != test.counter {
+			t.Errorf("%s %s = %+v, want %+v", test.key.portSpec, familyNames[test.key.family], *counter, test.counter)
+		}
+	}
+	if len(counters) != 3 {
+		t.Errorf("%d counters, want 3", len(counters))
+	}
+
+	if _, err := nftablesCounters("Error: No such file or directory", testNftablesConfig.flowKeys()); err == nil {
+		t.Error("bad json accepted")
+	}
+}
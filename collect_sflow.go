@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	sflowListen = flagSet.String("sflow.listen", ":6343", "udp address the sflow collector listens on")
+)
+
+func init() {
+	RegisterCollector("sflow", func(config *collectConfig) Collector {
+		return &sflowCollector{config: config}
+	})
+}
+
+//sample和record的格式，企业号为0的标准格式
+const (
+	sflowFlowSample            = 1
+	sflowCounterSample         = 2
+	sflowExpandedFlowSample    = 3
+	sflowExpandedCounterSample = 4
+
+	sflowRawPacketHeader = 1
+	sflowSampledIPv4     = 3
+	sflowSampledIPv6     = 4
+
+	sflowGenericInterfaceCounters = 1
+)
+
+//raw packet header中的header_protocol
+var sflowHeaderProtocols = map[uint32]int{
+	1:  linkTypeEthernet,
+	11: linkTypeIPv4,
+	12: linkTypeIPv6,
+}
+
+//counter sample中的接口计数，来自设备，都是累计值
+type sflowInterfaceKey struct {
+	agent   string
+	ifIndex uint32
+}
+
+//设备接口的累计计数，32位的计数回绕后继续累加
+type sflowInterfaceCounters struct {
+	inOctets    uint64
+	inPackets   uint64
+	inErrors    uint64
+	inDiscards  uint64
+	outOctets   uint64
+	outPackets  uint64
+	outErrors   uint64
+	outDiscards uint64
+	last        *sflowGenericCounters //上一次的原始读数
+}
+
+//generic interface counters的原始读数，除字节数外都是32位计数
+type sflowGenericCounters struct {
+	inOctets    uint64
+	inUcast     uint32
+	inMcast     uint32
+	inBcast     uint32
+	inDiscards  uint32
+	inErrors    uint32
+	outOctets   uint64
+	outUcast    uint32
+	outMcast    uint32
+	outBcast    uint32
+	outDiscards uint32
+	outErrors   uint32
+}
+
+//按原始读数的差累加，第一次以原始读数作为累计值
+func (s *sflowInterfaceCounters) update(raw *sflowGenericCounters) {
+	old := s.last
+	s.last = raw
+	if old == nil {
+		s.inOctets = raw.inOctets
+		s.inPackets = uint64(raw.inUcast) + uint64(raw.inMcast) + uint64(raw.inBcast)
+		s.inDiscards = uint64(raw.inDiscards)
+		s.inErrors = uint64(raw.inErrors)
+		s.outOctets = raw.outOctets
+		s.outPackets = uint64(raw.outUcast) + uint64(raw.outMcast) + uint64(raw.outBcast)
+		s.outDiscards = uint64(raw.outDiscards)
+		s.outErrors = uint64(raw.outErrors)
+		return
+	}
+
+	add64 := func(current, older uint64) uint64 {
+		d, _ := counterDelta(int64(current), int64(older), 0)
+		return uint64(d)
+	}
+	add32 := func(current, older uint32) uint64 {
+		d, _ := counterDelta(int64(current), int64(older), 32)
+		return uint64(d)
+	}
+	s.inOctets += add64(raw.inOctets, old.inOctets)
+	s.inPackets += add32(raw.inUcast, old.inUcast) + add32(raw.inMcast, old.inMcast) + add32(raw.inBcast, old.inBcast)
+	s.inDiscards += add32(raw.inDiscards, old.inDiscards)
+	s.inErrors += add32(raw.inErrors, old.inErrors)
+	s.outOctets += add64(raw.outOctets, old.outOctets)
+	s.outPackets += add32(raw.outUcast, old.outUcast) + add32(raw.outMcast, old.outMcast) + add32(raw.outBcast, old.outBcast)
+	s.outDiscards += add32(raw.outDiscards, old.outDiscards)
+	s.outErrors += add32(raw.outErrors, old.outErrors)
+}
+
+//作为sflow收集器，flow sample按采样率放大后按端口汇总，counter sample记录各设备接口的计数
+type sflowCollector struct {
+	config *collectConfig
+	conn   *net.UDPConn
+	done   chan struct{}
+	agg    *flowAggregator
+
+	mux        sync.Mutex
+	interfaces map[sflowInterfaceKey]*sflowInterfaceCounters
+
+	datagrams    uint64
+	decodeErrors uint64
+}
+
+func (c *sflowCollector) Setup() error {
+	addr, err := net.ResolveUDPAddr("udp", *sflowListen)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.done = make(chan struct{})
+	c.agg = newFlowAggregator(c.config)
+	c.mux.Lock()
+	c.interfaces = make(map[sflowInterfaceKey]*sflowInterfaceCounters)
+	c.mux.Unlock()
+	LOG_INFO_F("sflow collector listen on %s", conn.LocalAddr())
+
+	go func() {
+		defer close(c.done)
+		serveUDP(conn, c.handle)
+	}()
+	return nil
+}
+
+func (c *sflowCollector) handle(from string, data []byte) {
+	atomic.AddUint64(&c.datagrams, 1)
+	if err := c.decode(data); err != nil {
+		if atomic.AddUint64(&c.decodeErrors, 1)%100 == 1 {
+			LOG_WARN_F("decode sflow datagram from %s fail: %v (errors %d)", from, err, atomic.LoadUint64(&c.decodeErrors))
+		}
+	}
+}
+
+func (c *sflowCollector) Sample() (map[flowKey]*flowCounter, error) {
+	if c.agg == nil {
+		return nil, errors.New("sflow collector is not setup")
+	}
+	return c.agg.snapshot(), nil
+}
+
+func (c *sflowCollector) Teardown() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	<-c.done
+	c.conn = nil
+	return err
+}
+
+// ------------  sflow v5解码 ---------------
+
+//xdr编码，所有字段4字节对齐
+type xdrReader struct {
+	data []byte
+	err  error
+}
+
+var errSflowShort = errors.New("datagram too short")
+
+func (r *xdrReader) uint32() uint32 {
+	if r.err != nil || len(r.data) < 4 {
+		r.err = errSflowShort
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *xdrReader) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+//读取n字节，按4字节对齐跳过填充
+func (r *xdrReader) bytes(n int) []byte {
+	padded := (n + 3) &^ 3
+	if r.err != nil || n < 0 || len(r.data) < padded {
+		r.err = errSflowShort
+		return nil
+	}
+	v := r.data[:n]
+	r.data = r.data[padded:]
+	return v
+}
+
+//解码一个datagram
+func (c *sflowCollector) decode(data []byte) error {
+	r := &xdrReader{data: data}
+	if version := r.uint32(); r.err == nil && version != 5 {
+		return fmt.Errorf("unsupported sflow version %d", version)
+	}
+
+	var agent net.IP
+	switch addrType := r.uint32(); addrType {
+	case 1:
+		agent = net.IP(r.bytes(4))
+	case 2:
+		agent = net.IP(r.bytes(16))
+	default:
+		if r.err == nil {
+			return fmt.Errorf("unsupported agent address type %d", addrType)
+		}
+	}
+	r.uint32() //sub agent id
+	r.uint32() //sequence
+	r.uint32() //uptime
+	count := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		format := r.uint32()
+		sample := &xdrReader{data: r.bytes(int(r.uint32()))}
+		if r.err != nil {
+			return r.err
+		}
+		//只处理企业号为0的标准格式
+		if format>>12 != 0 {
+			continue
+		}
+		switch format & 0xfff {
+		case sflowFlowSample, sflowExpandedFlowSample:
+			c.decodeFlowSample(sample, format&0xfff == sflowExpandedFlowSample)
+		case sflowCounterSample, sflowExpandedCounterSample:
+			c.decodeCounterSample(agent.String(), sample, format&0xfff == sflowExpandedCounterSample)
+		}
+		if sample.err != nil {
+			return sample.err
+		}
+	}
+	return nil
+}
+
+//flow sample中按采样率放大：每个采样报文代表sampling_rate个报文
+func (c *sflowCollector) decodeFlowSample(r *xdrReader, expanded bool) {
+	r.uint32() //sequence
+	r.uint32() //source id
+	if expanded {
+		r.uint32()
+	}
+	rate := uint64(r.uint32())
+	r.uint32() //sample pool
+	r.uint32() //drops
+	r.uint32() //input
+	r.uint32() //output
+	if expanded {
+		r.uint32()
+		r.uint32()
+	}
+	if rate == 0 {
+		rate = 1
+	}
+
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		format := r.uint32()
+		record := &xdrReader{data: r.bytes(int(r.uint32()))}
+		if r.err != nil || format>>12 != 0 {
+			continue
+		}
+
+		//同一个sample可能同时带有原始报文头和解析后的记录，只取第一个能解出端口的
+		if info, ok := decodeSflowFlowRecord(format&0xfff, record); ok {
+			c.agg.add(&decodedFlow{
+				srcPort: info.srcPort,
+				dstPort: info.dstPort,
+				proto:   info.proto,
+				family:  info.family,
+				bytes:   uint64(info.length) * rate,
+				packets: rate,
+			})
+			return
+		}
+	}
+}
+
+func decodeSflowFlowRecord(format uint32, r *xdrReader) (*packetInfo, bool) {
+	switch format {
+	case sflowRawPacketHeader:
+		linkType, ok := sflowHeaderProtocols[r.uint32()]
+		frameLength := int(r.uint32())
+		r.uint32() //stripped
+		header := r.bytes(int(r.uint32()))
+		if !ok || r.err != nil {
+			return nil, false
+		}
+		info, ok := decodePacket(linkType, header)
+		if !ok {
+			return nil, false
+		}
+		//报文头被截断时ip长度仍然有效，取不到时用帧长度
+		if info.length <= 0 {
+			info.length = frameLength
+		}
+		return info, true
+	case sflowSampledIPv4, sflowSampledIPv6:
+		info := &packetInfo{family: familyIPv4}
+		addrLen := 4
+		if format == sflowSampledIPv6 {
+			info.family, addrLen = familyIPv6, 16
+		}
+		info.length = int(r.uint32())
+		info.proto = uint8(r.uint32())
+		r.bytes(addrLen) //src ip
+		r.bytes(addrLen) //dst ip
+		info.srcPort = uint16(r.uint32())
+		info.dstPort = uint16(r.uint32())
+		if r.err != nil || protoName(info.proto) == "" {
+			return nil, false
+		}
+		return info, true
+	}
+	return nil, false
+}
+
+//counter sample中只取通用接口计数
+func (c *sflowCollector) decodeCounterSample(agent string, r *xdrReader, expanded bool) {
+	r.uint32() //sequence
+	r.uint32() //source id
+	if expanded {
+		r.uint32()
+	}
+
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		format := r.uint32()
+		record := &xdrReader{data: r.bytes(int(r.uint32()))}
+		if r.err != nil || format != sflowGenericInterfaceCounters {
+			continue
+		}
+
+		ifIndex := record.uint32()
+		record.uint32() //ifType
+		record.uint64() //ifSpeed
+		record.uint32() //ifDirection
+		record.uint32() //ifStatus
+		raw := &sflowGenericCounters{}
+		raw.inOctets = record.uint64()
+		raw.inUcast = record.uint32()
+		raw.inMcast = record.uint32()
+		raw.inBcast = record.uint32()
+		raw.inDiscards = record.uint32()
+		raw.inErrors = record.uint32()
+		record.uint32() //ifInUnknownProtos
+		raw.outOctets = record.uint64()
+		raw.outUcast = record.uint32()
+		raw.outMcast = record.uint32()
+		raw.outBcast = record.uint32()
+		raw.outDiscards = record.uint32()
+		raw.outErrors = record.uint32()
+		if record.err != nil {
+			continue
+		}
+
+		key := sflowInterfaceKey{agent: agent, ifIndex: ifIndex}
+		c.mux.Lock()
+		counters, ok := c.interfaces[key]
+		if !ok {
+			counters = &sflowInterfaceCounters{}
+			c.interfaces[key] = counters
+		}
+		counters.update(raw)
+		c.mux.Unlock()
+	}
+}
+
+//输出设备接口的计数
+func (c *sflowCollector) writeMetrics(w *metricsWriter) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var keys []sflowInterfaceKey
+	for key := range c.interfaces {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].agent != keys[j].agent {
+			return keys[i].agent < keys[j].agent
+		}
+		return keys[i].ifIndex < keys[j].ifIndex
+	})
+
+	metrics := []struct {
+		name, help string
+		in, out    func(*sflowInterfaceCounters) uint64
+	}{
+		{"netflow_sflow_interface_bytes_total", "Octets of the device interface from sflow counter samples.",
+			func(s *sflowInterfaceCounters) uint64 { return s.inOctets }, func(s *sflowInterfaceCounters) uint64 { return s.outOctets }},
+		{"netflow_sflow_interface_packets_total", "Packets of the device interface from sflow counter samples.",
+			func(s *sflowInterfaceCounters) uint64 { return s.inPackets }, func(s *sflowInterfaceCounters) uint64 { return s.outPackets }},
+		{"netflow_sflow_interface_errors_total", "Errors of the device interface from sflow counter samples.",
+			func(s *sflowInterfaceCounters) uint64 { return s.inErrors }, func(s *sflowInterfaceCounters) uint64 { return s.outErrors }},
+		{"netflow_sflow_interface_discards_total", "Discards of the device interface from sflow counter samples.",
+			func(s *sflowInterfaceCounters) uint64 { return s.inDiscards }, func(s *sflowInterfaceCounters) uint64 { return s.outDiscards }},
+	}
+	for _, m := range metrics {
+		w.header(m.name, m.help, "counter")
+		for _, key := range keys {
+			counters := c.interfaces[key]
+			ifIndex := strconv.FormatUint(uint64(key.ifIndex), 10)
+			w.sample(m.name, float64(m.in(counters)), "agent", key.agent, "ifindex", ifIndex, "direction", "in")
+			w.sample(m.name, float64(m.out(counters)), "agent", key.agent, "ifindex", ifIndex, "direction", "out")
+		}
+	}
+
+	w.header("netflow_sflow_datagrams_total", "Sflow datagrams received.", "counter")
+	w.sample("netflow_sflow_datagrams_total", float64(atomic.LoadUint64(&c.datagrams)))
+	w.header("netflow_sflow_decode_errors_total", "Sflow datagrams failed to decode.", "counter")
+	w.sample("netflow_sflow_decode_errors_total", float64(atomic.LoadUint64(&c.decodeErrors)))
+}
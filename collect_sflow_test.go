@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+)
+
+//xdr变长数据：长度+内容，补齐到4字节
+func xdrOpaque(buf, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	for len(data)%4 != 0 {
+		buf, data = append(buf, 0), append(data, 0)
+	}
+	return buf
+}
+
+func xdrUint32s(buf []byte, values ...uint32) []byte {
+	for _, v := range values {
+		buf = binary.BigEndian.AppendUint32(buf, v)
+	}
+	return buf
+}
+
+//sample和record的结构相同：格式+长度+内容
+func sflowTestRecord(format uint32, body []byte) []byte {
+	return xdrOpaque(xdrUint32s(nil, format), body)
+}
+
+func sflowTestDatagram(agent net.IP, samples ...[]byte) []byte {
+	var buf []byte
+	if ip4 := agent.To4(); ip4 != nil {
+		buf = append(xdrUint32s(buf, 5, 1), ip4...)
+	} else {
+		buf = append(xdrUint32s(buf, 5, 2), agent.To16()...)
+	}
+	buf = xdrUint32s(buf, 0, 1, 1000, uint32(len(samples)))
+	for _, sample := range samples {
+		buf = append(buf, sample...)
+	}
+	return buf
+}
+
+func sflowTestFlowSample(expanded bool, rate uint32, records ...[]byte) []byte {
+	var body []byte
+	format := uint32(sflowFlowSample)
+	if expanded {
+		format = sflowExpandedFlowSample
+		body = xdrUint32s(body, 1, 0, 3, rate, 5000, 0, 0, 2, 0, 3, uint32(len(records)))
+	} else {
+		body = xdrUint32s(body, 1, 3, rate, 5000, 0, 2, 3, uint32(len(records)))
+	}
+	for _, record := range records {
+		body = append(body, record...)
+	}
+	return sflowTestRecord(format, body)
+}
+
+func sflowTestRawHeader(headerProtocol, frameLength uint32, header []byte) []byte {
+	return sflowTestRecord(sflowRawPacketHeader, xdrOpaque(xdrUint32s(nil, headerProtocol, frameLength, 4), header))
+}
+
+func sflowTestSampledIP(v6 bool, length uint32, proto uint8, srcPort, dstPort uint16) []byte {
+	format, addrLen := uint32(sflowSampledIPv4), 4
+	if v6 {
+		format, addrLen = sflowSampledIPv6, 16
+	}
+	body := xdrUint32s(nil, length, uint32(proto))
+	body = append(body, make([]byte, 2*addrLen)...)
+	body = xdrUint32s(body, uint32(srcPort), uint32(dstPort), 0, 0)
+	return sflowTestRecord(format, body)
+}
+
+func sflowTestCounterSample(expanded bool, ifIndex uint32, raw *sflowGenericCounters) []byte {
+	record := xdrUint32s(nil, ifIndex, 6)
+	record = binary.BigEndian.AppendUint64(record, 1e9)
+	record = xdrUint32s(record, 1, 3)
+	record = binary.BigEndian.AppendUint64(record, raw.inOctets)
+	record = xdrUint32s(record, raw.inUcast, raw.inMcast, raw.inBcast, raw.inDiscards, raw.inErrors, 0)
+	record = binary.BigEndian.AppendUint64(record, raw.outOctets)
+	record = xdrUint32s(record, raw.outUcast, raw.outMcast, raw.outBcast, raw.outDiscards, raw.outErrors, 0)
+
+	var body []byte
+	format := uint32(sflowCounterSample)
+	if expanded {
+		format = sflowExpandedCounterSample
+		body = xdrUint32s(body, 1, 0, ifIndex)
+	} else {
+		body = xdrUint32s(body, 1, ifIndex)
+	}
+	body = xdrUint32s(body, 2)
+	//非通用接口计数的record跳过
+	body = append(body, sflowTestRecord(2, make([]byte, 12))...)
+	body = append(body, sflowTestRecord(sflowGenericInterfaceCounters, record)...)
+	return sflowTestRecord(format, body)
+}
+
+//ipv6+udp报文，length为ip总长度
+func testIPv6Packet(srcPort, dstPort uint16, length int) []byte {
+	packet := make([]byte, 48)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], uint16(length-40))
+	packet[6] = 17
+	binary.BigEndian.PutUint16(packet[40:], srcPort)
+	binary.BigEndian.PutUint16(packet[42:], dstPort)
+	return packet
+}
+
+func newTestSflowCollector() *sflowCollector {
+	return &sflowCollector{
+		config:     testNetflowConfig,
+		agg:        newFlowAggregator(testNetflowConfig),
+		interfaces: make(map[sflowInterfaceKey]*sflowInterfaceCounters),
+	}
+}
+
+func TestSflowDecodeFlowSamples(t *testing.T) {
+	c := newTestSflowCollector()
+	datagram := sflowTestDatagram(net.ParseIP("192.0.2.1"),
+		//以太网报文头，按采样率100放大
+		sflowTestFlowSample(false, 100, sflowTestRawHeader(1, 74, testEthernetPacket(40000, 8080, 60))),
+		//扩展格式，ipv6报文头
+		sflowTestFlowSample(true, 10, sflowTestRawHeader(12, 134, testIPv6Packet(53, 5353, 120))),
+		//解析后的ipv4/ipv6记录
+		sflowTestFlowSample(false, 4, sflowTestSampledIP(false, 100, 17, 5353, 53)),
+		sflowTestFlowSample(true, 2, sflowTestSampledIP(true, 1000, 6, 8080, 40000)),
+		//采样率为0按1计算；解不出的报文头跳过，只取第一个能解出端口的record
+		sflowTestFlowSample(false, 0,
+			sflowTestRawHeader(99, 64, testIPv4Packet(1, 8080, 999)),
+			sflowTestSampledIP(false, 50, 6, 1234, 8080),
+			sflowTestSampledIP(false, 999, 6, 1234, 8080)),
+		//企业格式跳过
+		sflowTestRecord(9<<12|sflowFlowSample, sflowTestFlowSample(false, 1, sflowTestSampledIP(false, 999, 6, 1234, 8080))[8:]),
+	)
+	if err := c.decode(datagram); err != nil {
+		t.Fatal(err)
+	}
+
+	counters, _ := c.Sample()
+	tcp, udp := portSpec{proto: "tcp", port: 8080}, portSpec{proto: "udp", port: 53}
+	checkCounter(t, "sflow", counters, flowKey{tcp, familyIPv4}, flowCounter{inFlow: 6050, inPackets: 101})
+	checkCounter(t, "sflow", counters, flowKey{tcp, familyIPv6}, flowCounter{outFlow: 2000, outPackets: 2})
+	checkCounter(t, "sflow", counters, flowKey{udp, familyIPv4}, flowCounter{inFlow: 400, inPackets: 4})
+	checkCounter(t, "sflow", counters, flowKey{udp, familyIPv6}, flowCounter{outFlow: 1200, outPackets: 10})
+}
+
+func TestSflowDecodeCounterSamples(t *testing.T) {
+	c := newTestSflowCollector()
+	agent := net.ParseIP("2001:db8::1")
+	first := &sflowGenericCounters{inOctets: 1000, inUcast: math.MaxUint32, inMcast: 1, inErrors: 2, outOctets: 3000, outUcast: 30, outDiscards: 4}
+	if err := c.decode(sflowTestDatagram(agent,
+		sflowTestCounterSample(false, 3, first),
+		sflowTestCounterSample(true, 70000, &sflowGenericCounters{inOctets: 10, outOctets: 20}),
+	)); err != nil {
+		t.Fatal(err)
+	}
+	//单播包数回绕
+	second := &sflowGenericCounters{inOctets: 1500, inUcast: 9, inMcast: 1, inErrors: 2, outOctets: 3100, outUcast: 35, outDiscards: 5}
+	if err := c.decode(sflowTestDatagram(agent, sflowTestCounterSample(false, 3, second))); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.interfaces) != 2 {
+		t.Fatalf("interfaces = %d, want 2", len(c.interfaces))
+	}
+	got := c.interfaces[sflowInterfaceKey{agent: "2001:db8::1", ifIndex: 3}]
+	if got == nil || got.inOctets != 1500 || got.inPackets != math.MaxUint32+1+10 || got.inErrors != 2 ||
+		got.outOctets != 3100 || got.outPackets != 35 || got.outDiscards != 5 {
+		t.Errorf("ifindex 3 = %+v", got)
+	}
+	if got := c.interfaces[sflowInterfaceKey{agent: "2001:db8::1", ifIndex: 70000}]; got == nil || got.inOctets != 10 || got.outOctets != 20 {
+		t.Errorf("ifindex 70000 = %+v", got)
+	}
+}
+
+func TestSflowDecodeErrors(t *testing.T) {
+	c := newTestSflowCollector()
+	datagram := sflowTestDatagram(net.ParseIP("192.0.2.1"), sflowTestFlowSample(false, 1, sflowTestSampledIP(false, 100, 6, 1, 8080)))
+
+	bad := append([]byte(nil), datagram...)
+	binary.BigEndian.PutUint32(bad, 4)
+	if err := c.decode(bad); err == nil {
+		t.Error("sflow v4 should fail")
+	}
+	for n := 0; n < len(datagram); n += 4 {
+		if err := c.decode(datagram[:n]); err == nil {
+			t.Errorf("datagram truncated to %d bytes should fail", n)
+		}
+	}
+
+	//截断的数据不计数
+	counters, _ := c.Sample()
+	checkCounter(t, "truncated", counters, flowKey{portSpec{proto: "tcp", port: 8080}, familyIPv4}, flowCounter{})
+}
+
+func TestSflowInterfaceCountersWrap(t *testing.T) {
+	counters := &sflowInterfaceCounters{}
+	counters.update(&sflowGenericCounters{inOctets: 1000, inUcast: math.MaxUint32 - 4, inMcast: 7, inErrors: 3, outOctets: 2000, outUcast: 10})
+	if counters.inPackets != math.MaxUint32+3 || counters.inOctets != 1000 || counters.inErrors != 3 {
+		t.Fatalf("first update = %+v", counters)
+	}
+
+	//32位的单播包数回绕，字节数是64位照常相减
+	counters.update(&sflowGenericCounters{inOctets: 1600, inUcast: 5, inMcast: 8, inErrors: 3, outOctets: 2100, outUcast: 12})
+	if counters.inPackets != math.MaxUint32+3+10+1 {
+		t.Errorf("in packets = %d", counters.inPackets)
+	}
+	if counters.inOctets != 1600 || counters.outOctets != 2100 || counters.outPackets != 12 || counters.inErrors != 3 {
+		t.Errorf("second update = %+v", counters)
+	}
+}
@@ -2,15 +2,5 @@
 
 package main
 
-func (server *NetFlowServer) flowCollect() (in, out int64, err error) {
-	LOG_INFO("collect in windows")
-	return
-}
-
-func (server *NetFlowServer) cleanRecords() {
-
-}
-
-func (server *NetFlowServer) setupRecords() {
-
-}
+//windows下暂不支持端口流量采集
+const defaultCollector = "none"
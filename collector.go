@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//采集后端，负责端口计数规则的建立、读取与清理
+type Collector interface {
+	//建立采集规则
+	Setup() error
+	//读取各端口各地址族的累计计数
+	Sample() (map[flowKey]*flowCounter, error)
+	//清理采集规则
+	Teardown() error
+}
+
+//地址族
+const (
+	familyIPv4 = iota
+	familyIPv6
+)
+
+var familyNames = [...]string{
+	familyIPv4: "ipv4",
+	familyIPv6: "ipv6",
+}
+
+//计数的key：端口+地址族
+type flowKey struct {
+	portSpec
+	family int
+}
+
+//端口累计计数
+type flowCounter struct {
+	inFlow     int64
+	outFlow    int64
+	inPackets  int64
+	outPackets int64
+	inMissing  bool //入站计数本次没有读到
+	outMissing bool //出站计数本次没有读到
+}
+
+//两次读取之间计数的变化
+const (
+	counterNormal = iota
+	counterReset  //计数变小：被清零（iptables -Z）或规则被重建
+	counterWrap   //计数超过位宽后回绕
+)
+
+var counterEventNames = [...]string{
+	counterNormal: "normal",
+	counterReset:  "reset",
+	counterWrap:   "wrap",
+}
+
+//两次累计计数的差，计数按无符号处理（超过int64范围的64位计数转成int64后为负数）
+//计数变小时，上次接近位宽上限、这次接近0的按回绕计算，否则视为重置，
+//重置后的增量只能取当前值（重置前未读到的部分已丢失）
+func counterDelta(current, older int64, wrapBits uint) (int64, int) {
+	cur, old := uint64(current), uint64(older)
+	if cur >= old {
+		return int64(cur - old), counterNormal
+	}
+	if wrapBits == 0 || wrapBits > 64 {
+		wrapBits = 64
+	}
+	max := uint64(1)<<wrapBits - 1
+	quarter := max/4 + 1
+	if old <= max && old >= max-quarter+1 && cur < quarter {
+		return int64(max - old + cur + 1), counterWrap
+	}
+	return current, counterReset
+}
+
+//两次累计计数的差，返回最严重的变化类型（重置 > 回绕 > 正常）
+//各采集后端的端口计数都是64位的，位宽有限的计数（网卡、sflow接口）由调用方直接使用counterDelta
+func (counter *flowCounter) delta(older *flowCounter) (*flowCounter, int) {
+	event := counterNormal
+	sub := func(current, older int64) int64 {
+		d, e := counterDelta(current, older, 64)
+		if e == counterReset || (e == counterWrap && event == counterNormal) {
+			event = e
+		}
+		return d
+	}
+	delta := &flowCounter{
+		inFlow:     sub(counter.inFlow, older.inFlow),
+		outFlow:    sub(counter.outFlow, older.outFlow),
+		inPackets:  sub(counter.inPackets, older.inPackets),
+		outPackets: sub(counter.outPackets, older.outPackets),
+	}
+	return delta, event
+}
+
+//单个方向上规则计数的合计
+type ruleCounter struct {
+	packets int64
+	bytes   int64
+}
+
+//累加一条规则的计数
+func addRuleCounter(counters map[portSpec]*ruleCounter, spec portSpec, packets, bytes int64) {
+	counter, ok := counters[spec]
+	if !ok {
+		counter = &ruleCounter{}
+		counters[spec] = counter
+	}
+	counter.packets += packets
+	counter.bytes += bytes
+}
+
+//入站和出站的计数合成端口计数，没有读到的方向传nil，由调用方沿用上次的计数
+func newFlowCounter(in, out *ruleCounter) *flowCounter {
+	counter := &flowCounter{
+		inMissing:  in == nil,
+		outMissing: out == nil,
+	}
+	if in != nil {
+		counter.inFlow = in.bytes
+		counter.inPackets = in.packets
+	}
+	if out != nil {
+		counter.outFlow = out.bytes
+		counter.outPackets = out.packets
+	}
+	return counter
+}
+
+//是否有方向没有读到
+func (counter *flowCounter) missing() bool {
+	return counter.inMissing || counter.outMissing
+}
+
+//没有读到的方向沿用上次的计数，本窗口内该方向的增量为0，流量计入下一个读到的窗口
+func (counter *flowCounter) fillMissing(older *flowCounter) {
+	if counter.inMissing {
+		counter.inFlow = older.inFlow
+		counter.inPackets = older.inPackets
+	}
+	if counter.outMissing {
+		counter.outFlow = older.outFlow
+		counter.outPackets = older.outPackets
+	}
+}
+
+//缺失的方向名称，用于日志
+func (counter *flowCounter) missingNames() string {
+	var names []string
+	if counter.inMissing {
+		names = append(names, "in")
+	}
+	if counter.outMissing {
+		names = append(names, "out")
+	}
+	return strings.Join(names, ",")
+}
+
+//采集配置
+type collectConfig struct {
+	backend   string
+	portsList []portSpec
+	families  []int
+	interval  time.Duration
+}
+
+//解析-family参数：all|ipv4|ipv6
+func parseFamilies(text string) ([]int, error) {
+	switch strings.ToLower(strings.TrimSpace(text)) {
+	case "", "all":
+		return []int{familyIPv4, familyIPv6}, nil
+	case "ipv4":
+		return []int{familyIPv4}, nil
+	case "ipv6":
+		return []int{familyIPv6}, nil
+	}
+	return nil, fmt.Errorf("unsupported family[%s], available: all,ipv4,ipv6", text)
+}
+
+//所有端口在所有地址族下的key
+func (config *collectConfig) flowKeys() []flowKey {
+	var keys []flowKey
+	for _, spec := range config.portsList {
+		for _, family := range config.families {
+			keys = append(keys, flowKey{portSpec: spec, family: family})
+		}
+	}
+	return keys
+}
+
+var (
+	collectorFactories = make(map[string]func(config *collectConfig) Collector)
+)
+
+//注册采集后端
+func RegisterCollector(name string, factory func(config *collectConfig) Collector) {
+	if _, ok := collectorFactories[name]; ok {
+		panic(fmt.Sprintf("collector[%s] already registered", name))
+	}
+	collectorFactories[name] = factory
+}
+
+//根据名称创建采集后端
+func NewCollector(name string, config *collectConfig) (Collector, error) {
+	factory, ok := collectorFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported collector[%s], available: %s", name, strings.Join(CollectorNames(), ","))
+	}
+	return factory(config), nil
+}
+
+//已注册的采集后端名称
+func CollectorNames() []string {
+	var names []string
+	for name := range collectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ------------  空采集后端 ---------------
+
+//不做任何采集，用于不支持的平台或调试
+type noneCollector struct{}
+
+func init() {
+	RegisterCollector("none", func(config *collectConfig) Collector {
+		return &noneCollector{}
+	})
+}
+
+func (c *noneCollector) Setup() error {
+	return nil
+}
+
+func (c *noneCollector) Sample() (map[flowKey]*flowCounter, error) {
+	return map[flowKey]*flowCounter{}, nil
+}
+
+func (c *noneCollector) Teardown() error {
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  int64
+		older    int64
+		wrapBits uint
+		delta    int64
+		event    int
+	}{
+		{"normal", 1500, 1000, 0, 500, counterNormal},
+		{"unchanged", 1000, 1000, 0, 0, counterNormal},
+		{"reset", 200, 1000, 0, 200, counterReset},
+		{"reset to zero", 0, 1000, 32, 0, counterReset},
+		{"normal 32 bits", 1 << 31, 1 << 30, 32, 1 << 30, counterNormal},
+		{"wrap 32 bits", 100, math.MaxUint32 - 99, 32, 200, counterWrap},
+		{"wrap 32 bits at limit", 0, math.MaxUint32, 32, 1, counterWrap},
+		//上次离上限还远，不是回绕
+		{"reset 32 bits", 100, 1 << 31, 32, 100, counterReset},
+		//这次离0还远，不是回绕
+		{"reset 32 bits high", 1 << 30, math.MaxUint32, 32, 1 << 30, counterReset},
+		//超过32位的读数说明不是32位计数
+		{"reset above 32 bits", 100, 1 << 40, 32, 100, counterReset},
+		{"unsigned above int64", -1<<63 + 500, math.MaxInt64, 0, 501, counterNormal},
+		{"unsigned near max", -100, -1 << 63, 0, 1<<63 - 100, counterNormal},
+		{"wrap 64 bits", 50, -51, 0, 101, counterWrap},
+		{"wrap 64 bits by default", 50, -51, 64, 101, counterWrap},
+	}
+	for _, test := range tests {
+		delta, event := counterDelta(test.current, test.older, test.wrapBits)
+		if delta != test.delta || event != test.event {
+			t.Errorf("%s: counterDelta(%d, %d, %d) = %d, %s, want %d, %s", test.name, test.current, test.older, test.wrapBits,
+				delta, counterEventNames[event], test.delta, counterEventNames[test.event])
+		}
+	}
+}
+
+func TestFlowCounterDelta(t *testing.T) {
+	//64位计数接近上限时转成int64为负数
+	older := &flowCounter{inFlow: -10, outFlow: 100, inPackets: 10, outPackets: 10}
+	current := &flowCounter{inFlow: 10, outFlow: 150, inPackets: 12, outPackets: 11}
+	delta, event := current.delta(older)
+	if event != counterWrap || delta.inFlow != 20 || delta.outFlow != 50 || delta.inPackets != 2 || delta.outPackets != 1 {
+		t.Errorf("delta = %+v, %s", delta, counterEventNames[event])
+	}
+
+	//重置比回绕严重
+	current.outFlow = 10
+	if _, event = current.delta(older); event != counterReset {
+		t.Errorf("event = %s, want reset", counterEventNames[event])
+	}
+}
@@ -2,58 +2,22 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"fmt"
 	"os/exec"
+	"strings"
 )
 
-//pipe管道命令执行
-func Pipeline(cmds ...*exec.Cmd) (pipeLineOutput, collectedStandardError []byte, pipeLineError error) {
-	if len(cmds) < 1 {
-		return nil, nil, nil
-	}
-
-	var output bytes.Buffer
+//单命令执行，失败时带上stderr的内容
+func ExecCommand(cmd *exec.Cmd) (string, error) {
+	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
-	last := len(cmds) - 1
-	for i, cmd := range cmds[:last] {
-		var err error
-		if cmds[i+1].Stdin, err = cmd.StdoutPipe(); err != nil {
-			return nil, nil, err
-		}
-		cmd.Stderr = &stderr
-	}
-
-	cmds[last].Stdout, cmds[last].Stderr = &output, &stderr
-
-	for _, cmd := range cmds {
-		if err := cmd.Start(); err != nil {
-			return output.Bytes(), stderr.Bytes(), err
-		}
-	}
-
-	for _, cmd := range cmds {
-		if err := cmd.Wait(); err != nil {
-			return output.Bytes(), stderr.Bytes(), err
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %v: %s", cmd.Path, err, msg)
 		}
+		return "", fmt.Errorf("%s: %v", cmd.Path, err)
 	}
-
-	return output.Bytes(), stderr.Bytes(), nil
-}
-
-//多命令执行
-func ExecPipeLine(cmds ...*exec.Cmd) (string, error) {
-	output, stderr, err := Pipeline(cmds...)
-	if err != nil {
-		return "", err
-	}
-
-	if len(output) > 0 {
-		return string(output), nil
-	}
-
-	if len(stderr) > 0 {
-		return string(stderr), nil
-	}
-	return "", errors.New("no returns")
+	return stdout.String(), nil
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//网卡统计的来源
+const (
+	interfaceSourceProc  = "proc"
+	interfaceSourceSysfs = "sysfs"
+
+	procNetDevPath  = "/proc/net/dev"
+	sysClassNetPath = "/sys/class/net"
+)
+
+//网卡的累计计数
+type interfaceCounter struct {
+	rxBytes   int64
+	rxPackets int64
+	rxErrors  int64
+	rxDrops   int64
+	txBytes   int64
+	txPackets int64
+	txErrors  int64
+	txDrops   int64
+}
+
+//各计数中按无符号比较最大的值
+func (c *interfaceCounter) maxValue() uint64 {
+	var max uint64
+	for _, v := range []int64{c.rxBytes, c.rxPackets, c.rxErrors, c.rxDrops, c.txBytes, c.txPackets, c.txErrors, c.txDrops} {
+		if uint64(v) > max {
+			max = uint64(v)
+		}
+	}
+	return max
+}
+
+//解析/proc/net/dev，前两行为表头，每行为 名称: 接收8列 发送8列
+func parseProcNetDev(data []byte) (map[string]*interfaceCounter, error) {
+	counters := make(map[string]*interfaceCounter)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 0; scanner.Scan(); line++ {
+		if line < 2 {
+			continue
+		}
+		text := scanner.Text()
+		i := strings.LastIndexByte(text, ':')
+		if i < 0 {
+			continue
+		}
+		name := strings.TrimSpace(text[:i])
+		fields := strings.Fields(text[i+1:])
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("bad line in %s: %s", procNetDevPath, text)
+		}
+
+		var values [16]int64
+		for j := range values {
+			v, err := strconv.ParseUint(fields[j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad line in %s: %s", procNetDevPath, text)
+			}
+			values[j] = int64(v)
+		}
+		counters[name] = &interfaceCounter{
+			rxBytes:   values[0],
+			rxPackets: values[1],
+			rxErrors:  values[2],
+			rxDrops:   values[3],
+			txBytes:   values[8],
+			txPackets: values[9],
+			txErrors:  values[10],
+			txDrops:   values[11],
+		}
+	}
+	return counters, scanner.Err()
+}
+
+//读取/sys/class/net/<接口>/statistics下的计数文件
+func readSysfsStatistics(root string) (map[string]*interfaceCounter, error) {
+	dirs, err := filepath.Glob(filepath.Join(root, "*", "statistics"))
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]*interfaceCounter)
+	for _, dir := range dirs {
+		counter := &interfaceCounter{}
+		files := []struct {
+			name  string
+			value *int64
+		}{
+			{"rx_bytes", &counter.rxBytes},
+			{"rx_packets", &counter.rxPackets},
+			{"rx_errors", &counter.rxErrors},
+			{"rx_dropped", &counter.rxDrops},
+			{"tx_bytes", &counter.txBytes},
+			{"tx_packets", &counter.txPackets},
+			{"tx_errors", &counter.txErrors},
+			{"tx_dropped", &counter.txDrops},
+		}
+
+		ok := true
+		for _, file := range files {
+			data, err := ioutil.ReadFile(filepath.Join(dir, file.name))
+			if err != nil {
+				//读取过程中接口被删除
+				ok = false
+				break
+			}
+			v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad counter in %s: %v", filepath.Join(dir, file.name), err)
+			}
+			*file.value = int64(v)
+		}
+		if ok {
+			counters[filepath.Base(filepath.Dir(dir))] = counter
+		}
+	}
+	return counters, nil
+}
+
+//每次采集时读取网卡计数，与上次的差即窗口内的增量
+type interfaceStats struct {
+	source   string
+	path     string          //procNetDevPath或sysClassNetPath
+	filter   map[string]bool //nil表示所有接口
+	last     map[string]*interfaceCounter
+	lastTime time.Time
+
+	//驱动的计数可能是32位的（如32位内核上的unsigned long），
+	//读数超过32位的接口按64位计数处理，否则按32位判断回绕
+	wide map[string]bool
+}
+
+//names为接口列表，all表示所有接口
+func newInterfaceStats(source string, names []string) (*interfaceStats, error) {
+	if source != interfaceSourceProc && source != interfaceSourceSysfs {
+		return nil, fmt.Errorf("unsupported interface source[%s], available: proc,sysfs", source)
+	}
+	s := &interfaceStats{source: source, path: procNetDevPath, wide: make(map[string]bool)}
+	if source == interfaceSourceSysfs {
+		s.path = sysClassNetPath
+	}
+	for _, name := range names {
+		if name == "all" {
+			s.filter = nil
+			break
+		}
+		if s.filter == nil {
+			s.filter = make(map[string]bool)
+		}
+		s.filter[name] = true
+	}
+	return s, nil
+}
+
+//解析-interfaces参数，空表示不采集网卡统计
+func parseInterfaces(text string) []string {
+	var names []string
+	for _, name := range strings.Split(text, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s *interfaceStats) read() (map[string]*interfaceCounter, error) {
+	var counters map[string]*interfaceCounter
+	var err error
+	if s.source == interfaceSourceSysfs {
+		counters, err = readSysfsStatistics(s.path)
+	} else {
+		var data []byte
+		if data, err = ioutil.ReadFile(s.path); err == nil {
+			counters, err = parseProcNetDev(data)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.filter != nil {
+		for name := range counters {
+			if !s.filter[name] {
+				delete(counters, name)
+			}
+		}
+	}
+	return counters, nil
+}
+
+//以当前计数作为基线
+func (s *interfaceStats) reset(now time.Time) error {
+	counters, err := s.read()
+	if err != nil {
+		return err
+	}
+	s.last = counters
+	s.lastTime = now
+	return nil
+}
+
+//读取计数并返回各接口窗口内的增量，按名称排序
+//新出现的接口以本次读数为基线，和计数被重置的接口一样标记为不完整
+func (s *interfaceStats) sample(now time.Time) ([]*InterfaceNetFlow, error) {
+	counters, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	seconds := now.Sub(s.lastTime).Seconds()
+
+	var names []string
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var flows []*InterfaceNetFlow
+	for _, name := range names {
+		current := counters[name]
+		flow := &InterfaceNetFlow{Name: name}
+		flows = append(flows, flow)
+
+		if current.maxValue() > math.MaxUint32 {
+			s.wide[name] = true
+		}
+		older, ok := s.last[name]
+		if !ok {
+			flow.Partial = true
+			continue
+		}
+
+		wrapBits := uint(32)
+		if s.wide[name] {
+			wrapBits = 64
+		}
+		sub := func(current, older int64) int64 {
+			d, event := counterDelta(current, older, wrapBits)
+			if event != counterNormal {
+				flow.Partial = true
+			}
+			return d
+		}
+		flow.RxBytes = sub(current.rxBytes, older.rxBytes)
+		flow.RxPackets = sub(current.rxPackets, older.rxPackets)
+		flow.RxErrors = sub(current.rxErrors, older.rxErrors)
+		flow.RxDrops = sub(current.rxDrops, older.rxDrops)
+		flow.TxBytes = sub(current.txBytes, older.txBytes)
+		flow.TxPackets = sub(current.txPackets, older.txPackets)
+		flow.TxErrors = sub(current.txErrors, older.txErrors)
+		flow.TxDrops = sub(current.txDrops, older.txDrops)
+		if seconds > 0 {
+			flow.RxRate = float64(flow.RxBytes) / seconds
+			flow.TxRate = float64(flow.TxBytes) / seconds
+		}
+	}
+
+	s.last = counters
+	s.lastTime = now
+	return flows, nil
+}
+
+//输出最近一次读到的网卡累计计数，调用方持有server.mux
+func (s *interfaceStats) writeMetrics(w *metricsWriter) {
+	var names []string
+	for name := range s.last {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []struct {
+		name   string
+		help   string
+		values func(c *interfaceCounter) (int64, int64)
+	}{
+		{"netflow_interface_bytes_total", "Bytes on the interface reported by the kernel.",
+			func(c *interfaceCounter) (int64, int64) { return c.rxBytes, c.txBytes }},
+		{"netflow_interface_packets_total", "Packets on the interface reported by the kernel.",
+			func(c *interfaceCounter) (int64, int64) { return c.rxPackets, c.txPackets }},
+		{"netflow_interface_errors_total", "Errors on the interface reported by the kernel.",
+			func(c *interfaceCounter) (int64, int64) { return c.rxErrors, c.txErrors }},
+		{"netflow_interface_drops_total", "Dropped packets on the interface reported by the kernel.",
+			func(c *interfaceCounter) (int64, int64) { return c.rxDrops, c.txDrops }},
+	}
+	for _, metric := range metrics {
+		w.header(metric.name, metric.help, "counter")
+		for _, name := range names {
+			rx, tx := metric.values(s.last[name])
+			w.sample(metric.name, float64(rx), "interface", name, "direction", "rx")
+			w.sample(metric.name, float64(tx), "interface", name, "direction", "tx")
+		}
+	}
+}
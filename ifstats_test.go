@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseProcNetDev(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/proc-net-dev.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters, err := parseProcNetDev(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]*interfaceCounter{
+		"lo":       {rxBytes: 6753424, rxPackets: 52140, txBytes: 6753424, txPackets: 52140},
+		"eth0":     {rxBytes: -1, rxPackets: 123456, rxErrors: 2, rxDrops: 5, txBytes: 987654321, txPackets: 654321, txErrors: 1, txDrops: 3},
+		"eth0.100": {rxBytes: 200, rxPackets: 2, txBytes: 300, txPackets: 3},
+		"docker0":  {},
+	}
+	if !reflect.DeepEqual(counters, want) {
+		for name, counter := range counters {
+			t.Logf("%s: %+v", name, counter)
+		}
+		t.Error("counters mismatch")
+	}
+
+	for _, bad := range []string{
+		"h1\nh2\n  eth0: 1 2 3\n",
+		"h1\nh2\n  eth0: 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 x\n",
+		"h1\nh2\n  eth0: 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 -1\n",
+	} {
+		if _, err := parseProcNetDev([]byte(bad)); err == nil {
+			t.Errorf("parse %q should fail", bad)
+		}
+	}
+}
+
+//在root下生成 <接口>/statistics/<计数> 文件
+func writeSysfsStatistics(t *testing.T, root, name string, counter *interfaceCounter) {
+	dir := filepath.Join(root, name, "statistics")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]int64{
+		"rx_bytes": counter.rxBytes, "rx_packets": counter.rxPackets, "rx_errors": counter.rxErrors, "rx_dropped": counter.rxDrops,
+		"tx_bytes": counter.txBytes, "tx_packets": counter.txPackets, "tx_errors": counter.txErrors, "tx_dropped": counter.txDrops,
+	}
+	for file, value := range files {
+		text := strconv.FormatUint(uint64(value), 10) + "\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadSysfsStatistics(t *testing.T) {
+	root, err := ioutil.TempDir("", "netflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	eth0 := &interfaceCounter{rxBytes: 1000, rxPackets: 10, rxErrors: 1, rxDrops: 2, txBytes: 2000, txPackets: 20, txErrors: 3, txDrops: 4}
+	writeSysfsStatistics(t, root, "eth0", eth0)
+	writeSysfsStatistics(t, root, "lo", &interfaceCounter{rxBytes: math.MaxUint32 + 1})
+	//没有statistics目录的不是接口
+	if err := os.MkdirAll(filepath.Join(root, "bonding_masters"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	//读取过程中被删除的接口跳过
+	writeSysfsStatistics(t, root, "veth0", &interfaceCounter{})
+	os.Remove(filepath.Join(root, "veth0", "statistics", "tx_dropped"))
+
+	counters, err := readSysfsStatistics(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*interfaceCounter{
+		"eth0": eth0,
+		"lo":   {rxBytes: math.MaxUint32 + 1},
+	}
+	if !reflect.DeepEqual(counters, want) {
+		t.Errorf("counters = %v, want %v", counters, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "eth0", "statistics", "rx_bytes"), []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSysfsStatistics(root); err == nil {
+		t.Error("bad counter should fail")
+	}
+}
+
+func TestInterfaceStatsSample(t *testing.T) {
+	root, err := ioutil.TempDir("", "netflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s, err := newInterfaceStats(interfaceSourceSysfs, []string{"eth0", "eth1", "eth2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.path = root
+
+	start := time.Unix(1700000000, 0)
+	writeSysfsStatistics(t, root, "eth0", &interfaceCounter{rxBytes: 1000, txBytes: 500, rxPackets: 10, txPackets: 5})
+	writeSysfsStatistics(t, root, "eth1", &interfaceCounter{rxBytes: math.MaxUint32 - 99, txBytes: 1 << 40})
+	writeSysfsStatistics(t, root, "eth2", &interfaceCounter{rxBytes: math.MaxUint32 - 99})
+	writeSysfsStatistics(t, root, "lo", &interfaceCounter{rxBytes: 1})
+	if err := s.reset(start); err != nil {
+		t.Fatal(err)
+	}
+
+	//eth0正常增长，eth1计数是64位的，变小是重置；eth2没超过32位，按32位回绕，都标记为不完整；
+	//eth3不在列表中，lo被过滤
+	writeSysfsStatistics(t, root, "eth0", &interfaceCounter{rxBytes: 3000, txBytes: 1500, rxPackets: 30, txPackets: 15, rxDrops: 1})
+	writeSysfsStatistics(t, root, "eth1", &interfaceCounter{rxBytes: 100, txBytes: 1<<40 + 10})
+	writeSysfsStatistics(t, root, "eth2", &interfaceCounter{rxBytes: 100})
+	writeSysfsStatistics(t, root, "eth3", &interfaceCounter{rxBytes: 1})
+	flows, err := s.sample(start.Add(2 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*InterfaceNetFlow{
+		{Name: "eth0", RxBytes: 2000, TxBytes: 1000, RxPackets: 20, TxPackets: 10, RxDrops: 1, RxRate: 1000, TxRate: 500},
+		{Name: "eth1", RxBytes: 100, TxBytes: 10, RxRate: 50, TxRate: 5, Partial: true},
+		{Name: "eth2", RxBytes: 200, RxRate: 100, Partial: true},
+	}
+	if !reflect.DeepEqual(flows, want) {
+		for _, flow := range flows {
+			t.Logf("%+v", *flow)
+		}
+		t.Fatal("first sample mismatch")
+	}
+
+	//新出现的接口以本次读数为基线，标记为不完整
+	writeSysfsStatistics(t, root, "eth1", &interfaceCounter{rxBytes: 200, txBytes: 1<<40 + 10})
+	if err := os.RemoveAll(filepath.Join(root, "eth2")); err != nil {
+		t.Fatal(err)
+	}
+	s.filter["eth3"] = true
+	flows, err = s.sample(start.Add(4 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []*InterfaceNetFlow{
+		{Name: "eth0"},
+		{Name: "eth1", RxBytes: 100, RxRate: 50},
+		{Name: "eth3", Partial: true},
+	}
+	if !reflect.DeepEqual(flows, want) {
+		for _, flow := range flows {
+			t.Logf("%+v", *flow)
+		}
+		t.Fatal("second sample mismatch")
+	}
+}
+
+func TestInterfaceStatsProc(t *testing.T) {
+	s, err := newInterfaceStats(interfaceSourceProc, []string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.path = "testdata/proc-net-dev.txt"
+	if err := s.reset(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.last) != 4 || !reflect.DeepEqual(s.last["eth0.100"], &interfaceCounter{rxBytes: 200, rxPackets: 2, txBytes: 300, txPackets: 3}) {
+		t.Errorf("last = %v", s.last)
+	}
+
+	if _, err := newInterfaceStats("netlink", nil); err == nil {
+		t.Error("unknown source should fail")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//iptables-save -c 输出中的一条规则
+type iptablesSaveRule struct {
+	table   string
+	chain   string
+	packets int64
+	bytes   int64
+	args    []string //-A <chain> 之后的参数
+}
+
+//取规则中某个选项的值，如 --comment
+func (rule *iptablesSaveRule) option(name string) (string, bool) {
+	for i := 0; i+1 < len(rule.args); i++ {
+		if rule.args[i] == name {
+			return rule.args[i+1], true
+		}
+	}
+	return "", false
+}
+
+//解析iptables-save -c的输出，只保留带计数的-A规则
+func parseIptablesSave(data string) ([]*iptablesSaveRule, error) {
+	var rules []*iptablesSaveRule
+	table := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+			continue
+		case line == "COMMIT" || strings.HasPrefix(line, ":"):
+			continue
+		}
+
+		rule := &iptablesSaveRule{table: table}
+
+		//[packets:bytes] -A CHAIN ...
+		if strings.HasPrefix(line, "[") {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated counters", lineNo)
+			}
+			counters := strings.SplitN(line[1:end], ":", 2)
+			if len(counters) != 2 {
+				return nil, fmt.Errorf("line %d: bad counters %q", lineNo, line[:end+1])
+			}
+			var err error
+			if rule.packets, err = strconv.ParseInt(counters[0], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: bad packets counter: %v", lineNo, err)
+			}
+			if rule.bytes, err = strconv.ParseInt(counters[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: bad bytes counter: %v", lineNo, err)
+			}
+			line = strings.TrimSpace(line[end+1:])
+		}
+
+		args, err := splitIptablesArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if len(args) < 2 || args[0] != "-A" {
+			continue
+		}
+		rule.chain = args[1]
+		rule.args = args[2:]
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+//按iptables-save的引号规则切分参数，双引号内可用\"和\\转义
+func splitIptablesArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuote, inArg := false, false
+
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case inQuote && ch == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\'):
+			i++
+			current.WriteByte(line[i])
+		case ch == '"':
+			inQuote = !inQuote
+			inArg = true
+		case !inQuote && (ch == ' ' || ch == '\t'):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(ch)
+			inArg = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,152 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSplitIptablesArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"-A INPUT -j ACCEPT", []string{"-A", "INPUT", "-j", "ACCEPT"}},
+		{"-A  INPUT\t-j ACCEPT ", []string{"-A", "INPUT", "-j", "ACCEPT"}},
+		{`--comment "allow web traffic" -j ACCEPT`, []string{"--comment", "allow web traffic", "-j", "ACCEPT"}},
+		{`--comment "say \"hi\" \\ bye"`, []string{"--comment", `say "hi" \ bye`}},
+		{`--comment ""`, []string{"--comment", ""}},
+		{`--comment a"b c"d`, []string{"--comment", "ab cd"}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		args, err := splitIptablesArgs(test.line)
+		if err != nil {
+			t.Errorf("split %q: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("split %q = %q, want %q", test.line, args, test.args)
+		}
+	}
+
+	if _, err := splitIptablesArgs(`--comment "unterminated`); err == nil {
+		t.Error("unterminated quote accepted")
+	}
+}
+
+func TestParseIptablesSave(t *testing.T) {
+	rules, err := parseIptablesSave(readFixture(t, "iptables-save.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//表头、策略行和COMMIT都不是规则
+	tables := make(map[string]int)
+	for _, rule := range rules {
+		tables[rule.table]++
+	}
+	if want := map[string]int{"mangle": 1, "nat": 3, "filter": 13}; !reflect.DeepEqual(tables, want) {
+		t.Fatalf("rules per table = %v, want %v", tables, want)
+	}
+
+	var ssh *iptablesSaveRule
+	for _, rule := range rules {
+		if rule.table == "filter" && rule.chain == "INPUT" && rule.packets == 31 {
+			ssh = rule
+		}
+	}
+	if ssh == nil {
+		t.Fatal("ssh rule not found")
+	}
+	if ssh.bytes != 1860 {
+		t.Errorf("ssh rule bytes = %d, want 1860", ssh.bytes)
+	}
+	if comment, ok := ssh.option("--comment"); !ok || comment != `allow ssh from "office" network` {
+		t.Errorf("ssh rule comment = %q, %v", comment, ok)
+	}
+	if target, ok := ssh.option("-j"); !ok || target != "ACCEPT" {
+		t.Errorf("ssh rule target = %q, %v", target, ok)
+	}
+
+	last := rules[len(rules)-1]
+	if last.chain != iptablesInChain || last.packets != 5 || last.bytes != 300 {
+		t.Errorf("last rule = %+v", last)
+	}
+	if _, ok := last.option("--comment"); ok {
+		t.Error("rule without comment has a comment")
+	}
+}
+
+func TestParseIptablesSaveMalformed(t *testing.T) {
+	tests := []string{
+		"*filter\n[12:34 -A INPUT -j ACCEPT\n",
+		"*filter\n[1234] -A INPUT -j ACCEPT\n",
+		"*filter\n[x:34] -A INPUT -j ACCEPT\n",
+		"*filter\n[12:-] -A INPUT -j ACCEPT\n",
+		"*filter\n[12:34] -A INPUT -m comment --comment \"open -j ACCEPT\n",
+	}
+	for _, data := range tests {
+		if rules, err := parseIptablesSave(data); err == nil {
+			t.Errorf("parse %q = %v, want error", data, rules)
+		}
+	}
+
+	//没有计数的规则和不认识的行不是错误
+	rules, err := parseIptablesSave("*filter\n-A INPUT -j ACCEPT\n-N FOO\nCOMMIT\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].packets != 0 || rules[0].bytes != 0 {
+		t.Errorf("rules = %+v", rules)
+	}
+}
+
+func TestIptablesSaveCounters(t *testing.T) {
+	portsList := []portSpec{{proto: "tcp", port: 8080}, {proto: "tcp", port: 443}, {proto: "udp", port: 53}, {proto: "tcp", port: 9090}}
+
+	tests := []struct {
+		fixture string
+		family  int
+		want    map[flowKey]*flowCounter
+	}{
+		{"iptables-save.txt", familyIPv4, map[flowKey]*flowCounter{
+			//mangle表里同样注释的规则不计入
+			{portSpec: portsList[0], family: familyIPv4}: {inFlow: 2291877, outFlow: 21930177, inPackets: 18234, outPackets: 17990},
+			//同一个端口的多条规则累加
+			{portSpec: portsList[1], family: familyIPv4}: {inFlow: 98221 + 3300, outFlow: 1520044, inPackets: 1203 + 40, outPackets: 1189},
+			//出站规则丢失，入站照常读取
+			{portSpec: portsList[2], family: familyIPv4}: {inFlow: 70400, inPackets: 880, outMissing: true},
+		}},
+		{"ip6tables-save.txt", familyIPv6, map[flowKey]*flowCounter{
+			{portSpec: portsList[0], family: familyIPv6}: {inFlow: 40122, outFlow: 377810, inPackets: 311, outPackets: 298},
+			{portSpec: portsList[1], family: familyIPv6}: {},
+			{portSpec: portsList[2], family: familyIPv6}: {outFlow: 960, outPackets: 12, inMissing: true},
+		}},
+	}
+	for _, test := range tests {
+		counters, err := iptablesSaveCounters(readFixture(t, test.fixture), test.family, portsList)
+		if err != nil {
+			t.Fatalf("%s: %v", test.fixture, err)
+		}
+		//tcp/9090只有非自有注释的规则，不出现在结果中
+		if len(counters) != len(test.want) {
+			t.Errorf("%s: %d counters, want %d", test.fixture, len(counters), len(test.want))
+		}
+		for key, want := range test.want {
+			if got := counters[key]; got == nil || *got != *want {
+				t.Errorf("%s: counter of %s = %+v, want %+v", test.fixture, key.portSpec, got, want)
+			}
+		}
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"os"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,16 +19,72 @@ var testConfig = "{\"open\":true}"
 var (
 	flagSet  = flag.NewFlagSet("netFlow", flag.ExitOnError)
 	logLevel = flagSet.String("logLevel", "info", "log level")
-	ports    = flagSet.String("ports", "8080,18080,28080", "port which collect")
+	ports    = flagSet.String("ports", "8080,18080,28080", "port which collect, e.g. tcp/443,udp/53,sctp/3868 (default tcp)")
+	backend  = flagSet.String("collector", defaultCollector, "collect backend: iptables|nftables|afpacket|netflow|sflow|none")
+	family   = flagSet.String("family", "all", "address family which collect: all|ipv4|ipv6")
+	interval = flagSet.Duration("interval", time.Second, "collect interval, e.g. 250ms, 10s, 1m")
+	sinks    = flagSet.String("sinks", "log", "flow outputs, multiple sinks separated by comma")
+	sinkBuf  = flagSet.Int("sinkBuffer", 60*60, "buffered flows of each sink, flows are dropped when it is full")
+	ifNames  = flagSet.String("interfaces", "", "interfaces whose rx/tx totals are collected too, e.g. eth0,eth1 or all (default disabled)")
+	ifSource = flagSet.String("interfaceSource", interfaceSourceProc, "interface statistics source: proc (/proc/net/dev)|sysfs (/sys/class/net/*/statistics)")
 )
 
+//最小采集间隔，过小时读取本身的耗时会占满整个间隔
+const minCollectInterval = 100 * time.Millisecond
+
 type (
 
-	//主流量信息
+	//主流量信息，Bytes/Packets为采样窗口内的增量，Rate为按实际耗时换算的每秒速率
 	RootNetFlow struct {
-		InBytes   int64 `json:"in_Bytes"`
-		OutBytes  int64 `json:"out_Bytes"`
-		Timestamp int64 `json:"timestamp"`
+		InBytes       int64               `json:"in_Bytes"`
+		OutBytes      int64               `json:"out_Bytes"`
+		InPackets     int64               `json:"in_Packets"`
+		OutPackets    int64               `json:"out_Packets"`
+		InRate        float64             `json:"in_Rate"`
+		OutRate       float64             `json:"out_Rate"`
+		InPacketRate  float64             `json:"in_PacketRate"`
+		OutPacketRate float64             `json:"out_PacketRate"`
+		InBytesV4     int64               `json:"in_Bytes_v4"`
+		OutBytesV4    int64               `json:"out_Bytes_v4"`
+		InBytesV6     int64               `json:"in_Bytes_v6"`
+		OutBytesV6    int64               `json:"out_Bytes_v6"`
+		Ports         []*PortNetFlow      `json:"ports"`
+		Interfaces    []*InterfaceNetFlow `json:"interfaces,omitempty"` //开启-interfaces时各网卡的总流量
+		Partial       bool                `json:"partial"`              //有端口的计数被重置或回绕，窗口内的数据不完整
+		WindowStart   int64               `json:"window_start"`         //采样窗口起止，unix毫秒
+		WindowEnd     int64               `json:"window_end"`
+		Timestamp     int64               `json:"timestamp"`
+	}
+
+	//单个端口的流量信息，ipv4和ipv6合计
+	PortNetFlow struct {
+		Port          int     `json:"port"`
+		Protocol      string  `json:"protocol"`
+		InBytes       int64   `json:"in_Bytes"`
+		OutBytes      int64   `json:"out_Bytes"`
+		InPackets     int64   `json:"in_Packets"`
+		OutPackets    int64   `json:"out_Packets"`
+		InRate        float64 `json:"in_Rate"`
+		OutRate       float64 `json:"out_Rate"`
+		InPacketRate  float64 `json:"in_PacketRate"`
+		OutPacketRate float64 `json:"out_PacketRate"`
+		Partial       bool    `json:"partial"`
+	}
+
+	//单个网卡的流量信息，含不属于所采集端口的流量，rx为接收，tx为发送
+	InterfaceNetFlow struct {
+		Name      string  `json:"name"`
+		RxBytes   int64   `json:"rx_Bytes"`
+		TxBytes   int64   `json:"tx_Bytes"`
+		RxPackets int64   `json:"rx_Packets"`
+		TxPackets int64   `json:"tx_Packets"`
+		RxErrors  int64   `json:"rx_Errors"`
+		TxErrors  int64   `json:"tx_Errors"`
+		RxDrops   int64   `json:"rx_Drops"`
+		TxDrops   int64   `json:"tx_Drops"`
+		RxRate    float64 `json:"rx_Rate"`
+		TxRate    float64 `json:"tx_Rate"`
+		Partial   bool    `json:"partial"`
 	}
 
 	//流量配置信息
@@ -39,32 +94,144 @@ type (
 
 	//流量采集主服务
 	NetFlowServer struct {
-		mux                sync.RWMutex
-		once               sync.Once
-		flowChan           chan *RootNetFlow
-		openFlag           uint32
-		collectIntervalSec int
-		portsFlowCounters  []*collectInfo //0-in 1-out
-		portsList          []int
+		mux               sync.RWMutex
+		once              sync.Once
+		flowChan          chan *RootNetFlow
+		openFlag          uint32
+		collectInterval   time.Duration
+		portsFlowCounters []*collectInfo //0-in 1-out
+		config            *collectConfig
+		collector         Collector
+		dispatcher        *sinkDispatcher
+		lastFlow          *RootNetFlow //最近一次的采集结果，供api查询
+		counterResets     uint64       //计数重置次数
+		counterWraps      uint64       //计数回绕次数
+		stats             collectStats
+		portTotals        map[portSpec]*flowCounter //各端口自启动以来的累计增量，供/metrics输出
+		ifStats           *interfaceStats           //网卡统计，未开启时为nil
+	}
+
+	//采集自身的运行情况
+	collectStats struct {
+		samples        uint64
+		sampleErrors   uint64
+		lastDuration   time.Duration
+		lastSampleTime time.Time
 	}
 
 	collectInfo struct {
-		port    int
-		inFlow  int64
-		outFlow int64
+		flowKey
+		flowCounter           //上一次读到的累计计数
+		sampleTime  time.Time //上一次读取的时间，带单调时钟
+		carried     bool      //上一次有方向没有读到
 	}
 )
 
 func (rf *RootNetFlow) String() string {
-	return fmt.Sprintf("in_bytes: %d, out_bytes: %d, timestamp: %d", rf.InBytes, rf.OutBytes, rf.Timestamp)
+	var ports []string
+	for _, pf := range rf.Ports {
+		ports = append(ports, pf.String())
+	}
+	text := fmt.Sprintf("in_bytes: %d (v4 %d, v6 %d, %.1f B/s), out_bytes: %d (v4 %d, v6 %d, %.1f B/s), in_packets: %d, out_packets: %d, ports: [%s], partial: %v, window: %d-%d, timestamp: %d",
+		rf.InBytes, rf.InBytesV4, rf.InBytesV6, rf.InRate, rf.OutBytes, rf.OutBytesV4, rf.OutBytesV6, rf.OutRate,
+		rf.InPackets, rf.OutPackets, strings.Join(ports, ", "), rf.Partial, rf.WindowStart, rf.WindowEnd, rf.Timestamp)
+	if len(rf.Interfaces) > 0 {
+		var interfaces []string
+		for _, ifc := range rf.Interfaces {
+			interfaces = append(interfaces, ifc.String())
+		}
+		text += fmt.Sprintf(", interfaces: [%s]", strings.Join(interfaces, ", "))
+	}
+	return text
+}
+
+func (ifc *InterfaceNetFlow) String() string {
+	return fmt.Sprintf("%s rx %d (%d pkts, %.1f B/s, %d errs, %d drops) tx %d (%d pkts, %.1f B/s, %d errs, %d drops)",
+		ifc.Name, ifc.RxBytes, ifc.RxPackets, ifc.RxRate, ifc.RxErrors, ifc.RxDrops,
+		ifc.TxBytes, ifc.TxPackets, ifc.TxRate, ifc.TxErrors, ifc.TxDrops)
+}
+
+func (pf *PortNetFlow) String() string {
+	return fmt.Sprintf("%s/%d in %d (%d pkts, %.1f B/s) out %d (%d pkts, %.1f B/s)",
+		pf.Protocol, pf.Port, pf.InBytes, pf.InPackets, pf.InRate, pf.OutBytes, pf.OutPackets, pf.OutRate)
+}
+
+//按配置的端口顺序初始化每个端口的流量
+func newRootNetFlow(portsList []portSpec) *RootNetFlow {
+	rf := &RootNetFlow{}
+	for _, spec := range portsList {
+		rf.Ports = append(rf.Ports, &PortNetFlow{
+			Port:     spec.port,
+			Protocol: spec.proto,
+		})
+	}
+	return rf
 }
 
-func NewNetFlowServer(portsList []int) *NetFlowServer {
+//按端口和地址族累加，seconds为这段增量的实际耗时
+func (rf *RootNetFlow) add(key flowKey, delta *flowCounter, seconds float64) {
+	inRate := float64(delta.inFlow) / seconds
+	outRate := float64(delta.outFlow) / seconds
+	inPacketRate := float64(delta.inPackets) / seconds
+	outPacketRate := float64(delta.outPackets) / seconds
+
+	for _, pf := range rf.Ports {
+		if pf.Port == key.port && pf.Protocol == key.proto {
+			pf.InBytes += delta.inFlow
+			pf.OutBytes += delta.outFlow
+			pf.InPackets += delta.inPackets
+			pf.OutPackets += delta.outPackets
+			pf.InRate += inRate
+			pf.OutRate += outRate
+			pf.InPacketRate += inPacketRate
+			pf.OutPacketRate += outPacketRate
+			break
+		}
+	}
+
+	rf.InBytes += delta.inFlow
+	rf.OutBytes += delta.outFlow
+	rf.InPackets += delta.inPackets
+	rf.OutPackets += delta.outPackets
+	rf.InRate += inRate
+	rf.OutRate += outRate
+	rf.InPacketRate += inPacketRate
+	rf.OutPacketRate += outPacketRate
+	switch key.family {
+	case familyIPv4:
+		rf.InBytesV4 += delta.inFlow
+		rf.OutBytesV4 += delta.outFlow
+	case familyIPv6:
+		rf.InBytesV6 += delta.inFlow
+		rf.OutBytesV6 += delta.outFlow
+	}
+}
+
+//标记端口的数据不完整
+func (rf *RootNetFlow) markPartial(key flowKey) {
+	rf.Partial = true
+	for _, pf := range rf.Ports {
+		if pf.Port == key.port && pf.Protocol == key.proto {
+			pf.Partial = true
+			break
+		}
+	}
+}
+
+func NewNetFlowServer(config *collectConfig, collector Collector, dispatcher *sinkDispatcher, ifStats *interfaceStats) *NetFlowServer {
 	server := &NetFlowServer{
-		flowChan:           make(chan *RootNetFlow, 60*60),
-		openFlag:           0,
-		collectIntervalSec: 1, //秒级采集
-		portsList:          portsList,
+		flowChan:        make(chan *RootNetFlow, 60*60),
+		openFlag:        0,
+		collectInterval: config.interval,
+		config:          config,
+		portTotals:      make(map[portSpec]*flowCounter),
+		collector:       collector,
+		dispatcher:      dispatcher,
+		ifStats:         ifStats,
+	}
+
+	for _, spec := range config.portsList {
+		server.portTotals[spec] = &flowCounter{}
 	}
 
 	server.cleanRecords()
@@ -123,39 +290,150 @@ func (server *NetFlowServer) syncConfig() {
 //重置流量状态
 func (server *NetFlowServer) resetFlow() {
 	LOG_INFO(">>>>>>>>>>>>>>>>> reset flow status")
-	//初始化流量计数器
+	//初始化流量计数器，规则刚建立时计数为0，以此刻作为第一个采样窗口的起点
+	now := time.Now()
 	var counters []*collectInfo
-	for _, port := range server.portsList {
+	for _, key := range server.config.flowKeys() {
 		cf := &collectInfo{
-			port:    port,
-			inFlow:  0,
-			outFlow: 0,
+			flowKey:    key,
+			sampleTime: now,
 		}
 		counters = append(counters, cf)
 	}
 	server.portsFlowCounters = counters
+
+	if server.ifStats != nil {
+		if err := server.ifStats.reset(now); err != nil {
+			LOG_ERROR_F("read interface statistics fail: %v", err)
+		}
+	}
+}
+
+func (server *NetFlowServer) flowCollect() (flow *RootNetFlow, err error) {
+
+	//因为Linux的流量是累加值，所以要通过历史的计数器相减得到窗口内的增量，
+	//再除以两次读取的实际间隔得到速率（ticker可能延迟，读取本身也有耗时，不能用名义间隔）
+
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	begin := time.Now()
+	counters, err := server.collector.Sample()
+	now := time.Now()
+	server.stats.samples++
+	server.stats.lastDuration = now.Sub(begin)
+	if err != nil {
+		server.stats.sampleErrors++
+		return
+	}
+	server.stats.lastSampleTime = now
+
+	flow = newRootNetFlow(server.config.portsList)
+	flow.WindowStart = now.UnixMilli()
+	flow.WindowEnd = now.UnixMilli()
+	flow.Timestamp = now.Unix()
+
+	for _, collectInfo := range server.portsFlowCounters {
+
+		if collectInfo.port <= 0 {
+			continue
+		}
+
+		//采集失败的端口由采集后端记录日志，这里保留上次的计数
+		counter, ok := counters[collectInfo.flowKey]
+		if !ok {
+			continue
+		}
+
+		//只缺一个方向时另一个方向照常计算，缺失的方向沿用上次的计数
+		missing := counter.missing()
+		counter.fillMissing(&collectInfo.flowCounter)
+		delta, event := counter.delta(&collectInfo.flowCounter)
+		seconds := now.Sub(collectInfo.sampleTime).Seconds()
+		if seconds <= 0 {
+			continue
+		}
+
+		//计数重置或回绕时以本次读数重新建立基线，并把本次采样标记为不完整
+		switch event {
+		case counterReset:
+			atomic.AddUint64(&server.counterResets, 1)
+		case counterWrap:
+			atomic.AddUint64(&server.counterWraps, 1)
+		}
+		if event != counterNormal {
+			LOG_WARN_F("counter of port %s (%s) %s, rebaseline from in: %d out: %d",
+				collectInfo.portSpec, familyNames[collectInfo.family], counterEventNames[event], counter.inFlow, counter.outFlow)
+			flow.markPartial(collectInfo.flowKey)
+		}
+		//缺失方向的流量会计入下一次读到的窗口，两个窗口都不完整
+		if missing || collectInfo.carried {
+			flow.markPartial(collectInfo.flowKey)
+		}
+		collectInfo.carried = missing
+
+		//窗口取所有端口中最早的起点
+		if start := collectInfo.sampleTime.UnixMilli(); start < flow.WindowStart {
+			flow.WindowStart = start
+		}
+
+		collectInfo.flowCounter = *counter
+		collectInfo.sampleTime = now
+
+		flow.add(collectInfo.flowKey, delta, seconds)
+
+		total := server.portTotals[collectInfo.portSpec]
+		total.inFlow += delta.inFlow
+		total.outFlow += delta.outFlow
+		total.inPackets += delta.inPackets
+		total.outPackets += delta.outPackets
+	}
+
+	//网卡统计读取失败不影响端口流量的输出
+	if server.ifStats != nil {
+		interfaces, ifErr := server.ifStats.sample(now)
+		if ifErr != nil {
+			LOG_ERROR_F("read interface statistics fail: %v", ifErr)
+		}
+		flow.Interfaces = interfaces
+	}
+	return
+}
+
+//建立采集规则
+func (server *NetFlowServer) setupRecords() {
+	if err := server.collector.Setup(); err != nil {
+		LOG_ERROR(err)
+	}
+}
+
+//清理采集规则
+func (server *NetFlowServer) cleanRecords() {
+	if err := server.collector.Teardown(); err != nil {
+		LOG_ERROR(err)
+	}
 }
 
 func (server *NetFlowServer) timerFlowCollect() {
 
 	//最小采集间隔
-	if server.collectIntervalSec <= 0 {
-		server.collectIntervalSec = 1
+	if server.collectInterval < minCollectInterval {
+		LOG_WARN_F("collect interval %v is too small, use %v", server.collectInterval, minCollectInterval)
+		server.collectInterval = minCollectInterval
 	}
 
-	dur := time.Duration(server.collectIntervalSec) * time.Second
+	dur := server.collectInterval
 	ticker := time.NewTicker(dur) //这里选用计时器，因为不知道collect要多久
 	for {
 		select {
 		case <-ticker.C:
 			if !server.IsClosed() {
-				in, out, err := server.flowCollect()
+				flow, err := server.flowCollect()
 				if err == nil {
-					server.flowChan <- &RootNetFlow{
-						InBytes:   in,
-						OutBytes:  out,
-						Timestamp: time.Now().Unix(),
-					}
+					server.mux.Lock()
+					server.lastFlow = flow
+					server.mux.Unlock()
+					server.flowChan <- flow
 				} else {
 					LOG_ERROR(err)
 				}
@@ -168,11 +446,8 @@ func (server *NetFlowServer) timerFlowCollect() {
 
 //流量处理
 func (server *NetFlowServer) handleNetflow() {
-	for {
-		select {
-		case flow := <-server.flowChan:
-			LOG_INFO_F("receive a flow: %v", flow)
-		}
+	for flow := range server.flowChan {
+		server.dispatcher.dispatch(flow)
 	}
 }
 
@@ -187,6 +462,7 @@ func (server *NetFlowServer) open() {
 		server.mux.Lock()
 		defer server.mux.Unlock()
 		server.setupRecords()
+		server.resetFlow()
 	}
 }
 
@@ -203,26 +479,66 @@ func (server *NetFlowServer) close() {
 
 func (server *NetFlowServer) Shutdown() {
 	LOG_INFO("shutdown netflow")
+	server.dispatcher.Close()
 }
 
 func main() {
 
+	//子命令
+	if len(os.Args) > 1 && os.Args[1] == "analyze" {
+		os.Exit(analyzeMain(os.Args[2:]))
+	}
+
 	//日志初始化
 	_ = flagSet.Parse(os.Args[1:])
 
 	INIT_LOG(runtime.GOOS, *logLevel)
 
-	var portsList []int
+	portsList, errs := parsePortsList(*ports)
+	for _, err := range errs {
+		LOG_WARN(err)
+	}
 
-	for _, port := range strings.Split(*ports, ",") {
-		iPort, err := strconv.Atoi(port)
-		if err != nil || iPort <= 0 {
-			continue
+	families, err := parseFamilies(*family)
+	if err != nil {
+		LOG_ERROR(err)
+		LOG_FLUSH()
+		os.Exit(1)
+	}
+
+	config := &collectConfig{
+		backend:   *backend,
+		portsList: portsList,
+		families:  families,
+		interval:  *interval,
+	}
+
+	collector, err := NewCollector(*backend, config)
+	if err != nil {
+		LOG_ERROR(err)
+		LOG_FLUSH()
+		os.Exit(1)
+	}
+
+	sinkFlags.interfaces = len(parseInterfaces(*ifNames)) > 0
+	dispatcher, err := newSinkDispatcher(strings.Split(*sinks, ","), *sinkBuf, sinkFlags)
+	if err != nil {
+		LOG_ERROR(err)
+		LOG_FLUSH()
+		os.Exit(1)
+	}
+
+	var ifStats *interfaceStats
+	if names := parseInterfaces(*ifNames); len(names) > 0 {
+		ifStats, err = newInterfaceStats(*ifSource, names)
+		if err != nil {
+			LOG_ERROR(err)
+			LOG_FLUSH()
+			os.Exit(1)
 		}
-		portsList = append(portsList, iPort)
 	}
 
-	server := NewNetFlowServer(portsList)
+	server := NewNetFlowServer(config, collector, dispatcher, ifStats)
 
 	go server.Start()
 	//事件监听
@@ -235,6 +551,8 @@ func main() {
 func (server *NetFlowServer) openApi() {
 	http.HandleFunc("/on", server.testOnHandler)
 	http.HandleFunc("/off", server.testOffHandler)
+	http.HandleFunc("/flow", server.flowHandler)
+	http.HandleFunc("/metrics", server.metricsHandler)
 
 	var err error
 	err = http.ListenAndServe("0.0.0.0:25555", nil)
@@ -255,3 +573,24 @@ func (server *NetFlowServer) testOffHandler(rspWriter http.ResponseWriter, req *
 	testConfig = "{\"open\":false}"
 	_, _ = rspWriter.Write([]byte("off ok"))
 }
+
+//查询最近一次的采集结果，包含每个端口的明细
+func (server *NetFlowServer) flowHandler(rspWriter http.ResponseWriter, req *http.Request) {
+	server.mux.RLock()
+	flow := server.lastFlow
+	server.mux.RUnlock()
+
+	if flow == nil {
+		http.Error(rspWriter, "no flow collected yet", http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(flow)
+	if err != nil {
+		LOG_ERROR(err)
+		http.Error(rspWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rspWriter.Header().Set("Content-Type", "application/json")
+	_, _ = rspWriter.Write(data)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+func TestMain(m *testing.M) {
+	//测试中不写日志文件
+	g_log = seelog.Disabled
+	os.Exit(m.Run())
+}
+
+//按顺序返回预设的读数，用于测试采集服务
+type fakeCollector struct {
+	samples   []map[flowKey]*flowCounter
+	errs      []error
+	tick      int
+	setups    int
+	teardowns int
+}
+
+func (c *fakeCollector) Setup() error {
+	c.setups++
+	return nil
+}
+
+func (c *fakeCollector) Sample() (map[flowKey]*flowCounter, error) {
+	i := c.tick
+	c.tick++
+	if c.errs[i] != nil {
+		return nil, c.errs[i]
+	}
+	return c.samples[i], nil
+}
+
+func (c *fakeCollector) Teardown() error {
+	c.teardowns++
+	return nil
+}
+
+func testCounter(in, out int64) *flowCounter {
+	return newFlowCounter(&ruleCounter{bytes: in, packets: in / 10}, &ruleCounter{bytes: out, packets: out / 10})
+}
+
+func TestFlowCollect(t *testing.T) {
+	web := portSpec{proto: "tcp", port: 8080}
+	dns := portSpec{proto: "udp", port: 53}
+	config := &collectConfig{portsList: []portSpec{web, dns}, families: []int{familyIPv4, familyIPv6}, interval: time.Second}
+	web4, web6 := flowKey{web, familyIPv4}, flowKey{web, familyIPv6}
+	dns4 := flowKey{dns, familyIPv4}
+
+	collector := &fakeCollector{
+		samples: []map[flowKey]*flowCounter{
+			//dns的ipv6一直读不到
+			{web4: testCounter(100, 50), web6: testCounter(10, 5), dns4: testCounter(20, 0)},
+			//web的ipv4出站规则丢失
+			{web4: newFlowCounter(&ruleCounter{bytes: 300, packets: 30}, nil), web6: testCounter(10, 5), dns4: testCounter(50, 0)},
+			//出站恢复，上个窗口的流量计入本窗口；web的ipv6计数被重置
+			{web4: testCounter(300, 80), web6: testCounter(3, 0), dns4: testCounter(50, 0)},
+			nil,
+			{web4: testCounter(400, 100), web6: testCounter(13, 0), dns4: testCounter(50, 0)},
+		},
+		errs: []error{nil, nil, nil, errors.New("sample fail"), nil},
+	}
+	server := NewNetFlowServer(config, collector, nil, nil)
+	if collector.teardowns != 1 {
+		t.Errorf("teardown %d times on start", collector.teardowns)
+	}
+
+	want := []struct {
+		inBytes, outBytes int64
+		inV4, inV6        int64
+		partial           []bool //web, dns
+		err               bool
+	}{
+		{130, 55, 120, 10, []bool{false, false}, false},
+		{230, 0, 230, 0, []bool{true, false}, false},
+		{3, 30, 0, 3, []bool{true, false}, false},
+		{0, 0, 0, 0, nil, true},
+		{110, 20, 100, 10, []bool{false, false}, false},
+	}
+	for i, w := range want {
+		//把上次读取的时间往前推2s，速率按实际间隔换算
+		begin := time.Now().Add(-2 * time.Second)
+		for _, info := range server.portsFlowCounters {
+			info.sampleTime = begin
+		}
+
+		flow, err := server.flowCollect()
+		if w.err {
+			if err == nil {
+				t.Errorf("tick %d: error not returned", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tick %d: %v", i, err)
+		}
+		if flow.InBytes != w.inBytes || flow.OutBytes != w.outBytes || flow.InBytesV4 != w.inV4 || flow.InBytesV6 != w.inV6 {
+			t.Errorf("tick %d: in %d out %d (v4 %d, v6 %d)", i, flow.InBytes, flow.OutBytes, flow.InBytesV4, flow.InBytesV6)
+		}
+		if flow.Ports[0].Partial != w.partial[0] || flow.Ports[1].Partial != w.partial[1] || flow.Partial != (w.partial[0] || w.partial[1]) {
+			t.Errorf("tick %d: partial %v, ports %v %v", i, flow.Partial, flow.Ports[0].Partial, flow.Ports[1].Partial)
+		}
+		if flow.WindowStart != begin.UnixMilli() || flow.WindowEnd-flow.WindowStart < 2000 || flow.WindowEnd-flow.WindowStart > 2500 {
+			t.Errorf("tick %d: window %d-%d, want start %d", i, flow.WindowStart, flow.WindowEnd, begin.UnixMilli())
+		}
+		seconds := float64(flow.WindowEnd-flow.WindowStart) / 1000
+		if rate := float64(flow.InBytes) / seconds; math.Abs(flow.InRate-rate) > rate*0.01 {
+			t.Errorf("tick %d: in rate %v, want about %v", i, flow.InRate, rate)
+		}
+	}
+
+	if server.counterResets != 1 || server.counterWraps != 0 {
+		t.Errorf("resets %d, wraps %d", server.counterResets, server.counterWraps)
+	}
+	if server.stats.samples != 5 || server.stats.sampleErrors != 1 {
+		t.Errorf("samples %d, errors %d", server.stats.samples, server.stats.sampleErrors)
+	}
+	//web ipv4 400/100，ipv6 重置前10/5、重置后3+10
+	if total := server.portTotals[web]; total.inFlow != 423 || total.outFlow != 105 || total.inPackets != 42 {
+		t.Errorf("web total %+v", total)
+	}
+	if total := server.portTotals[dns]; total.inFlow != 50 || total.outFlow != 0 {
+		t.Errorf("dns total %+v", total)
+	}
+}
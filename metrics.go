@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+//prometheus文本格式中标签值只转义反斜杠、双引号和换行，其他字符原样输出
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//prometheus文本格式的指标输出
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+//写入指标的HELP和TYPE
+func (w *metricsWriter) header(name, help, metricType string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+//写入一个样本，labels按name,value成对传入
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&w.buf, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.buf.WriteByte('\n')
+}
+
+//采集后端可以实现此接口，输出自己的指标，调用方持有server.mux的读锁，
+//与Setup/Teardown互斥
+type metricsProvider interface {
+	writeMetrics(w *metricsWriter)
+}
+
+//输出各端口的累计流量和采集自身的指标
+func (server *NetFlowServer) metricsHandler(rspWriter http.ResponseWriter, req *http.Request) {
+	w := &metricsWriter{}
+	backend := server.config.backend
+
+	server.mux.RLock()
+
+	w.header("netflow_bytes_total", "Bytes counted on the port since the agent started.", "counter")
+	for _, spec := range server.config.portsList {
+		total := server.portTotals[spec]
+		port := strconv.Itoa(spec.port)
+		w.sample("netflow_bytes_total", float64(total.inFlow), "port", port, "proto", spec.proto, "direction", "in")
+		w.sample("netflow_bytes_total", float64(total.outFlow), "port", port, "proto", spec.proto, "direction", "out")
+	}
+
+	w.header("netflow_packets_total", "Packets counted on the port since the agent started.", "counter")
+	for _, spec := range server.config.portsList {
+		total := server.portTotals[spec]
+		port := strconv.Itoa(spec.port)
+		w.sample("netflow_packets_total", float64(total.inPackets), "port", port, "proto", spec.proto, "direction", "in")
+		w.sample("netflow_packets_total", float64(total.outPackets), "port", port, "proto", spec.proto, "direction", "out")
+	}
+
+	if server.ifStats != nil {
+		server.ifStats.writeMetrics(w)
+	}
+
+	stats := server.stats
+
+	w.header("netflow_collector_samples_total", "Samples taken from the collect backend.", "counter")
+	w.sample("netflow_collector_samples_total", float64(stats.samples), "collector", backend)
+
+	w.header("netflow_collector_sample_errors_total", "Samples failed in the collect backend.", "counter")
+	w.sample("netflow_collector_sample_errors_total", float64(stats.sampleErrors), "collector", backend)
+
+	w.header("netflow_collector_counter_resets_total", "Counter resets detected, such as iptables -Z or rules recreated.", "counter")
+	w.sample("netflow_collector_counter_resets_total", float64(atomic.LoadUint64(&server.counterResets)), "collector", backend)
+
+	w.header("netflow_collector_counter_wraps_total", "Counter wraparounds detected.", "counter")
+	w.sample("netflow_collector_counter_wraps_total", float64(atomic.LoadUint64(&server.counterWraps)), "collector", backend)
+
+	w.header("netflow_collector_last_sample_duration_seconds", "Time spent in the last sample.", "gauge")
+	w.sample("netflow_collector_last_sample_duration_seconds", stats.lastDuration.Seconds(), "collector", backend)
+
+	w.header("netflow_collector_last_sample_timestamp_seconds", "Unix time of the last successful sample.", "gauge")
+	lastSample := 0.0
+	if !stats.lastSampleTime.IsZero() {
+		lastSample = float64(stats.lastSampleTime.UnixNano()) / 1e9
+	}
+	w.sample("netflow_collector_last_sample_timestamp_seconds", lastSample, "collector", backend)
+
+	w.header("netflow_collector_open", "Whether the flow collect is turned on.", "gauge")
+	open := 0.0
+	if !server.IsClosed() {
+		open = 1
+	}
+	w.sample("netflow_collector_open", open, "collector", backend)
+
+	if provider, ok := server.collector.(metricsProvider); ok {
+		provider.writeMetrics(w)
+	}
+	server.mux.RUnlock()
+
+	w.header("netflow_sink_dropped_total", "Flows dropped because the sink buffer is full.", "counter")
+	for _, worker := range server.dispatcher.workers {
+		w.sample("netflow_sink_dropped_total", float64(atomic.LoadUint64(&worker.dropped)), "sink", worker.name)
+	}
+
+	w.header("netflow_sink_errors_total", "Flows failed to write to the sink.", "counter")
+	for _, worker := range server.dispatcher.workers {
+		w.sample("netflow_sink_errors_total", float64(atomic.LoadUint64(&worker.errors)), "sink", worker.name)
+	}
+
+	rspWriter.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = rspWriter.Write(w.buf.Bytes())
+}
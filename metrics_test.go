@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriterLabelEscape(t *testing.T) {
+	w := &metricsWriter{}
+	w.sample("netflow_interface_bytes_total", 1500, "interface", "eth0\tvlan\"é\"\\\n\x00", "direction", "rx")
+	want := "netflow_interface_bytes_total{interface=\"eth0\tvlan\\\"é\\\"\\\\\\n\x00\",direction=\"rx\"} 1500\n"
+	if got := w.buf.String(); got != want {
+		t.Errorf("sample = %q, want %q", got, want)
+	}
+
+	w = &metricsWriter{}
+	w.sample("netflow_sflow_datagrams_total", 0)
+	if got := w.buf.String(); got != "netflow_sflow_datagrams_total 0\n" {
+		t.Errorf("sample without labels = %q", got)
+	}
+}
+
+//输出指标时检查是否持有server.mux
+type lockCheckCollector struct {
+	fakeCollector
+	server *NetFlowServer
+	locked bool
+}
+
+func (c *lockCheckCollector) writeMetrics(w *metricsWriter) {
+	if c.server.mux.TryLock() {
+		c.server.mux.Unlock()
+	} else {
+		c.locked = true
+	}
+	w.header("netflow_fake_total", "Fake collector metric.", "counter")
+	w.sample("netflow_fake_total", 1)
+}
+
+func TestMetricsProviderLocked(t *testing.T) {
+	config := &collectConfig{backend: "fake", portsList: []portSpec{{proto: "tcp", port: 8080}}, families: []int{familyIPv4}}
+	collector := &lockCheckCollector{}
+	server := NewNetFlowServer(config, collector, &sinkDispatcher{}, nil)
+	collector.server = server
+
+	rsp := httptest.NewRecorder()
+	server.metricsHandler(rsp, httptest.NewRequest("GET", "/metrics", nil))
+	if !collector.locked {
+		t.Error("collector metrics written without server.mux held")
+	}
+	if body := rsp.Body.String(); !strings.Contains(body, "netflow_fake_total 1\n") || !strings.Contains(body, `netflow_bytes_total{port="8080",proto="tcp",direction="in"} 0`) {
+		t.Errorf("metrics = %s", body)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+//netflow v5/v9和ipfix协议的常量
+
+//协议版本
+const (
+	netflowV5 = 5
+	netflowV9 = 9
+	ipfixV10  = 10
+)
+
+//报文头长度
+const (
+	netflowV5HeaderLen = 24
+	netflowV5RecordLen = 48
+	netflowV5MaxCount  = 30
+	netflowV9HeaderLen = 20
+	ipfixHeaderLen     = 16
+)
+
+//flowset/set id
+const (
+	netflowV9TemplateSetID     = 0
+	netflowV9OptionsSetID      = 1
+	ipfixTemplateSetID         = 2
+	ipfixOptionsSetID          = 3
+	netflowMinDataSetID        = 256
+	netflowExportTemplateID    = 256
+	netflowExportMaxPacketSize = 1400
+)
+
+//用到的字段类型，v9与ipfix的编号相同
+const (
+	fieldInBytes                = 1
+	fieldInPkts                 = 2
+	fieldProtocol               = 4
+	fieldL4SrcPort              = 7
+	fieldL4DstPort              = 11
+	fieldLastSwitched           = 21
+	fieldFirstSwitched          = 22
+	fieldIPv6SrcAddr            = 27
+	fieldIPv6DstAddr            = 28
+	fieldSamplingInterval       = 34
+	fieldIPVersion              = 60
+	fieldDirection              = 61
+	fieldFlowStartMillis        = 152
+	fieldFlowEndMillis          = 153
+	fieldSamplingPacketInterval = 305
+)
+
+//DIRECTION字段的值
+const (
+	netflowDirectionIngress = 0
+	netflowDirectionEgress  = 1
+)
+
+//模板中的一个字段
+type netflowField struct {
+	fieldType uint16
+	length    uint16
+}
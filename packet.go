@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+//链路层类型，取值同pcap的LINKTYPE
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	etherHeaderLen = 14
+)
+
+//从报文头中解出的信息，统计端口流量用
+type packetInfo struct {
+	family  int
+	proto   uint8
+	srcPort uint16
+	dstPort uint16
+	length  int //ip报文长度
+}
+
+//解析一个报文，不是ip报文或取不到端口（如非首个分片）时返回false
+func decodePacket(linkType int, data []byte) (*packetInfo, bool) {
+	switch linkType {
+	case linkTypeEthernet:
+		return decodeEthernet(data)
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return decodeIP(data)
+	case linkTypeNull:
+		//4字节主机序的协议族，之后为ip报文
+		if len(data) < 4 {
+			return nil, false
+		}
+		return decodeIP(data[4:])
+	case linkTypeLinuxSLL:
+		//16字节头，协议类型在最后2字节
+		if len(data) < 16 {
+			return nil, false
+		}
+		return decodeEtherPayload(binary.BigEndian.Uint16(data[14:]), data[16:])
+	case linkTypeLinuxSLL2:
+		//20字节头，协议类型在最前2字节
+		if len(data) < 20 {
+			return nil, false
+		}
+		return decodeEtherPayload(binary.BigEndian.Uint16(data), data[20:])
+	}
+	return nil, false
+}
+
+//以太网帧，跳过vlan标签
+func decodeEthernet(data []byte) (*packetInfo, bool) {
+	if len(data) < etherHeaderLen {
+		return nil, false
+	}
+	etherType := binary.BigEndian.Uint16(data[12:])
+	data = data[etherHeaderLen:]
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(data) < 4 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(data[2:])
+		data = data[4:]
+	}
+	return decodeEtherPayload(etherType, data)
+}
+
+func decodeEtherPayload(etherType uint16, data []byte) (*packetInfo, bool) {
+	switch etherType {
+	case etherTypeIPv4, etherTypeIPv6:
+		return decodeIP(data)
+	}
+	return nil, false
+}
+
+//按版本号解析ipv4或ipv6
+func decodeIP(data []byte) (*packetInfo, bool) {
+	if len(data) < 1 {
+		return nil, false
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return decodeIPv4(data)
+	case 6:
+		return decodeIPv6(data)
+	}
+	return nil, false
+}
+
+func decodeIPv4(data []byte) (*packetInfo, bool) {
+	if len(data) < 20 {
+		return nil, false
+	}
+	headerLen := int(data[0]&0x0f) * 4
+	//非首个分片没有传输层头
+	if headerLen < 20 || binary.BigEndian.Uint16(data[6:])&0x1fff != 0 {
+		return nil, false
+	}
+	info := &packetInfo{
+		family: familyIPv4,
+		proto:  data[9],
+		length: int(binary.BigEndian.Uint16(data[2:])),
+	}
+	return decodeTransport(info, data, headerLen)
+}
+
+//ipv6扩展头
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6DestOpts = 60
+)
+
+func decodeIPv6(data []byte) (*packetInfo, bool) {
+	if len(data) < 40 {
+		return nil, false
+	}
+	info := &packetInfo{
+		family: familyIPv6,
+		length: 40 + int(binary.BigEndian.Uint16(data[4:])),
+	}
+
+	next, offset := data[6], 40
+	for {
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOpts:
+			if len(data) < offset+8 {
+				return nil, false
+			}
+			next, offset = data[offset], offset+(int(data[offset+1])+1)*8
+			continue
+		case ipv6Fragment:
+			if len(data) < offset+8 {
+				return nil, false
+			}
+			if binary.BigEndian.Uint16(data[offset+2:])&0xfff8 != 0 {
+				return nil, false
+			}
+			next, offset = data[offset], offset+8
+			continue
+		}
+		break
+	}
+	info.proto = next
+	return decodeTransport(info, data, offset)
+}
+
+//tcp/udp/sctp的前4字节都是源端口和目的端口
+func decodeTransport(info *packetInfo, data []byte, offset int) (*packetInfo, bool) {
+	if protoName(info.proto) == "" || len(data) < offset+4 {
+		return nil, false
+	}
+	info.srcPort = binary.BigEndian.Uint16(data[offset:])
+	info.dstPort = binary.BigEndian.Uint16(data[offset+2:])
+	return info, true
+}
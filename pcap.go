@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+//抓包文件中的一个报文
+type capturePacket struct {
+	timestamp time.Time
+	linkType  int
+	data      []byte //抓到的部分，可能被snaplen截断
+	length    int    //原始长度
+}
+
+//按顺序读取抓包文件中的报文，读完返回io.EOF
+type captureReader interface {
+	next() (*capturePacket, error)
+}
+
+const (
+	pcapMagicMicro   = 0xa1b2c3d4
+	pcapMagicNano    = 0xa1b23c4d
+	pcapngSHBType    = 0x0a0d0d0a
+	pcapngByteOrder  = 0x1a2b3c4d
+	pcapMaxBlockSize = 64 * 1024 * 1024
+)
+
+//根据文件头识别pcap或pcapng
+func openCapture(r io.Reader) (captureReader, error) {
+	br := bufio.NewReaderSize(r, 1<<16)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read capture header fail: %v", err)
+	}
+
+	switch {
+	case binary.BigEndian.Uint32(magic) == pcapngSHBType:
+		return &pcapngReader{r: br}, nil
+	case binary.LittleEndian.Uint32(magic) == pcapMagicMicro, binary.LittleEndian.Uint32(magic) == pcapMagicNano,
+		binary.BigEndian.Uint32(magic) == pcapMagicMicro, binary.BigEndian.Uint32(magic) == pcapMagicNano:
+		return newPcapReader(br)
+	}
+	return nil, errors.New("unknown capture format, only pcap and pcapng are supported")
+}
+
+// ------------  pcap ---------------
+
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType int
+	header   [16]byte
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	pr := &pcapReader{r: r, order: binary.LittleEndian}
+	magic := binary.LittleEndian.Uint32(header[:])
+	if magic != pcapMagicMicro && magic != pcapMagicNano {
+		pr.order = binary.BigEndian
+		magic = binary.BigEndian.Uint32(header[:])
+	}
+	pr.nano = magic == pcapMagicNano
+	//高位可能带有FCS等标志
+	pr.linkType = int(pr.order.Uint32(header[20:]) & 0x0fffffff)
+	return pr, nil
+}
+
+func (pr *pcapReader) next() (*capturePacket, error) {
+	if _, err := io.ReadFull(pr.r, pr.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated pcap record header")
+		}
+		return nil, err
+	}
+
+	sec := int64(pr.order.Uint32(pr.header[0:]))
+	frac := int64(pr.order.Uint32(pr.header[4:]))
+	capLen := pr.order.Uint32(pr.header[8:])
+	if capLen > pcapMaxBlockSize {
+		return nil, fmt.Errorf("bad pcap record length %d", capLen)
+	}
+	if !pr.nano {
+		frac *= int64(time.Microsecond)
+	}
+
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, errors.New("truncated pcap record")
+	}
+	return &capturePacket{
+		timestamp: time.Unix(sec, frac),
+		linkType:  pr.linkType,
+		data:      data,
+		length:    int(pr.order.Uint32(pr.header[12:])),
+	}, nil
+}
+
+// ------------  pcapng ---------------
+
+//pcapng的接口描述，每个section重新编号
+type pcapngInterface struct {
+	linkType int
+	tsRate   uint64 //每秒的时间戳数，默认微秒
+}
+
+type pcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []*pcapngInterface
+	lastTime   time.Time //simple packet block没有时间戳，沿用上一个报文的
+}
+
+//pcapng的block类型
+const (
+	pcapngIDBType = 1
+	pcapngOPBType = 2
+	pcapngSPBType = 3
+	pcapngEPBType = 6
+)
+
+func (pr *pcapngReader) next() (*capturePacket, error) {
+	for {
+		blockType, body, err := pr.readBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		switch blockType {
+		case pcapngIDBType:
+			if len(body) < 8 {
+				return nil, errors.New("bad pcapng interface block")
+			}
+			pr.interfaces = append(pr.interfaces, pr.parseInterface(body))
+		case pcapngEPBType, pcapngOPBType:
+			if len(body) < 20 {
+				return nil, errors.New("bad pcapng packet block")
+			}
+			var id int
+			if blockType == pcapngEPBType {
+				id = int(pr.order.Uint32(body))
+			} else {
+				id = int(pr.order.Uint16(body))
+			}
+			if id >= len(pr.interfaces) {
+				return nil, fmt.Errorf("pcapng packet of unknown interface %d", id)
+			}
+			ifc := pr.interfaces[id]
+			ts := uint64(pr.order.Uint32(body[4:]))<<32 | uint64(pr.order.Uint32(body[8:]))
+			capLen := int(pr.order.Uint32(body[12:]))
+			if capLen > len(body)-20 {
+				return nil, errors.New("bad pcapng packet length")
+			}
+			pr.lastTime = ifc.time(ts)
+			return &capturePacket{
+				timestamp: pr.lastTime,
+				linkType:  ifc.linkType,
+				data:      body[20 : 20+capLen],
+				length:    int(pr.order.Uint32(body[16:])),
+			}, nil
+		case pcapngSPBType:
+			if len(body) < 4 || len(pr.interfaces) == 0 {
+				return nil, errors.New("bad pcapng simple packet block")
+			}
+			length := int(pr.order.Uint32(body))
+			capLen := length
+			if capLen > len(body)-4 {
+				capLen = len(body) - 4
+			}
+			return &capturePacket{
+				timestamp: pr.lastTime,
+				linkType:  pr.interfaces[0].linkType,
+				data:      body[4 : 4+capLen],
+				length:    length,
+			}, nil
+		}
+		//其他block（统计、名称解析等）跳过
+	}
+}
+
+//读取一个block，返回类型和去掉首尾长度后的内容；section header在这里处理字节序
+func (pr *pcapngReader) readBlock() (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(pr.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, errors.New("truncated pcapng block header")
+		}
+		return 0, nil, err
+	}
+
+	//section header的类型是回文，与字节序无关，字节序由其后的magic决定
+	blockType := binary.BigEndian.Uint32(header[:])
+	if blockType == pcapngSHBType {
+		var magic [4]byte
+		if _, err := io.ReadFull(pr.r, magic[:]); err != nil {
+			return 0, nil, errors.New("truncated pcapng section header")
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic[:]) == pcapngByteOrder:
+			pr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic[:]) == pcapngByteOrder:
+			pr.order = binary.BigEndian
+		default:
+			return 0, nil, errors.New("bad pcapng byte order magic")
+		}
+		pr.interfaces = nil
+
+		length := pr.order.Uint32(header[4:])
+		if length < 16 || length > pcapMaxBlockSize {
+			return 0, nil, fmt.Errorf("bad pcapng block length %d", length)
+		}
+		rest := make([]byte, length-12)
+		if _, err := io.ReadFull(pr.r, rest); err != nil {
+			return 0, nil, errors.New("truncated pcapng section header")
+		}
+		return blockType, rest[:len(rest)-4], nil
+	}
+
+	if pr.order == nil {
+		return 0, nil, errors.New("pcapng block before section header")
+	}
+	blockType = pr.order.Uint32(header[:])
+	length := pr.order.Uint32(header[4:])
+	if length < 12 || length%4 != 0 || length > pcapMaxBlockSize {
+		return 0, nil, fmt.Errorf("bad pcapng block length %d", length)
+	}
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(pr.r, body); err != nil {
+		return 0, nil, errors.New("truncated pcapng block")
+	}
+	return blockType, body[:len(body)-4], nil
+}
+
+//interface description block，只关心链路类型和if_tsresol选项
+func (pr *pcapngReader) parseInterface(body []byte) *pcapngInterface {
+	ifc := &pcapngInterface{
+		linkType: int(pr.order.Uint16(body)),
+		tsRate:   1000000,
+	}
+
+	options := body[8:]
+	for len(options) >= 4 {
+		code := pr.order.Uint16(options)
+		length := int(pr.order.Uint16(options[2:]))
+		padded := (length + 3) &^ 3
+		if len(options) < 4+padded {
+			break
+		}
+		value := options[4 : 4+length]
+		options = options[4+padded:]
+
+		if code == 0 {
+			break
+		}
+		//if_tsresol
+		if code == 9 && length == 1 {
+			ifc.tsRate = pcapngTimeRate(value[0])
+		}
+	}
+	return ifc
+}
+
+//if_tsresol换算为每秒的时间戳数：最高位为0时单位为10^-n秒，为1时为2^-n秒
+func pcapngTimeRate(resolution byte) uint64 {
+	n := uint(resolution & 0x7f)
+	if resolution&0x80 != 0 {
+		if n > 63 {
+			n = 63
+		}
+		return uint64(1) << n
+	}
+	rate := uint64(1)
+	for i := uint(0); i < n && i < 19; i++ {
+		rate *= 10
+	}
+	return rate
+}
+
+func (ifc *pcapngInterface) time(ts uint64) time.Time {
+	sec, frac := ts/ifc.tsRate, ts%ifc.tsRate
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, ifc.tsRate)
+	return time.Unix(int64(sec), int64(nsec))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+//ipv4+tcp报文，length为ip总长度
+func testIPv4Packet(srcPort, dstPort uint16, length int) []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(length))
+	packet[9] = 6
+	binary.BigEndian.PutUint16(packet[20:], srcPort)
+	binary.BigEndian.PutUint16(packet[22:], dstPort)
+	packet[32] = 0x50
+	return packet
+}
+
+//以太网头+ipv4
+func testEthernetPacket(srcPort, dstPort uint16, length int) []byte {
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	return append(frame, testIPv4Packet(srcPort, dstPort, length)...)
+}
+
+//同时支持Put和Append的字节序
+type testByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type testCapturePacket struct {
+	sec, frac uint32
+	data      []byte
+}
+
+func buildPcap(order testByteOrder, magic uint32, linkType uint32, packets []testCapturePacket) []byte {
+	buf := make([]byte, 24)
+	order.PutUint32(buf, magic)
+	order.PutUint16(buf[4:], 2)
+	order.PutUint16(buf[6:], 4)
+	order.PutUint32(buf[16:], 65535)
+	order.PutUint32(buf[20:], linkType)
+	for _, p := range packets {
+		record := make([]byte, 16)
+		order.PutUint32(record, p.sec)
+		order.PutUint32(record[4:], p.frac)
+		order.PutUint32(record[8:], uint32(len(p.data)))
+		order.PutUint32(record[12:], uint32(len(p.data)))
+		buf = append(buf, record...)
+		buf = append(buf, p.data...)
+	}
+	return buf
+}
+
+//pcapng block：类型、长度、内容（补齐到4字节）、长度
+func pcapngBlock(order testByteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(12 + len(body))
+	block := make([]byte, 8, length)
+	order.PutUint32(block, blockType)
+	order.PutUint32(block[4:], length)
+	block = append(block, body...)
+	return order.AppendUint32(block, length)
+}
+
+func pcapngSHB(order testByteOrder) []byte {
+	body := order.AppendUint32(nil, pcapngByteOrder)
+	body = order.AppendUint16(body, 1)
+	body = order.AppendUint16(body, 0)
+	body = order.AppendUint64(body, 0xffffffffffffffff)
+	return pcapngBlock(order, pcapngSHBType, body)
+}
+
+//tsresol为0时不带if_tsresol选项
+func pcapngIDB(order testByteOrder, linkType uint16, tsresol byte) []byte {
+	body := order.AppendUint16(nil, linkType)
+	body = order.AppendUint16(body, 0)
+	body = order.AppendUint32(body, 65535)
+	if tsresol != 0 {
+		body = order.AppendUint16(body, 9)
+		body = order.AppendUint16(body, 1)
+		body = append(body, tsresol, 0, 0, 0)
+		body = order.AppendUint32(body, 0) //opt_endofopt
+	}
+	return pcapngBlock(order, pcapngIDBType, body)
+}
+
+func pcapngEPB(order testByteOrder, iface uint32, ts uint64, data []byte) []byte {
+	body := order.AppendUint32(nil, iface)
+	body = order.AppendUint32(body, uint32(ts>>32))
+	body = order.AppendUint32(body, uint32(ts))
+	body = order.AppendUint32(body, uint32(len(data)))
+	body = order.AppendUint32(body, uint32(len(data)))
+	return pcapngBlock(order, pcapngEPBType, append(body, data...))
+}
+
+func readAllPackets(t *testing.T, data []byte) []*capturePacket {
+	reader, err := openCapture(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets []*capturePacket
+	for {
+		packet, err := reader.next()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func checkPacket(t *testing.T, name string, packet *capturePacket, ts time.Time, linkType int, srcPort uint16) {
+	t.Helper()
+	if !packet.timestamp.Equal(ts) {
+		t.Errorf("%s: timestamp = %v, want %v", name, packet.timestamp.UTC(), ts.UTC())
+	}
+	if packet.linkType != linkType || packet.length != len(packet.data) {
+		t.Errorf("%s: link type %d, length %d/%d", name, packet.linkType, len(packet.data), packet.length)
+	}
+	info, ok := decodePacket(packet.linkType, packet.data)
+	if !ok || info.srcPort != srcPort {
+		t.Errorf("%s: decoded %+v, %v", name, info, ok)
+	}
+}
+
+func TestPcapReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    testByteOrder
+		magic    uint32
+		linkType uint32
+		frac     uint32
+		unit     time.Duration
+	}{
+		{"little endian micro", binary.LittleEndian, pcapMagicMicro, linkTypeRaw, 250000, time.Microsecond},
+		{"big endian micro", binary.BigEndian, pcapMagicMicro, linkTypeRaw, 250000, time.Microsecond},
+		{"little endian nano", binary.LittleEndian, pcapMagicNano, linkTypeRaw, 250000001, time.Nanosecond},
+		//链路类型的高位带FCS标志
+		{"big endian nano with fcs flag", binary.BigEndian, pcapMagicNano, 0x50000000 | linkTypeEthernet, 999999999, time.Nanosecond},
+	}
+	for _, test := range tests {
+		linkType := int(test.linkType & 0x0fffffff)
+		makePacket := testIPv4Packet
+		if linkType == linkTypeEthernet {
+			makePacket = testEthernetPacket
+		}
+		data := buildPcap(test.order, test.magic, test.linkType, []testCapturePacket{
+			{1700000000, test.frac, makePacket(8080, 40000, 40)},
+			{1700000001, 0, makePacket(40000, 8080, 40)},
+		})
+
+		packets := readAllPackets(t, data)
+		if len(packets) != 2 {
+			t.Fatalf("%s: %d packets, want 2", test.name, len(packets))
+		}
+		checkPacket(t, test.name, packets[0], time.Unix(1700000000, int64(test.frac)*int64(test.unit)), linkType, 8080)
+		checkPacket(t, test.name, packets[1], time.Unix(1700000001, 0), linkType, 40000)
+	}
+}
+
+func TestPcapngReader(t *testing.T) {
+	for _, order := range []testByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var data []byte
+		data = append(data, pcapngSHB(order)...)
+		data = append(data, pcapngIDB(order, linkTypeRaw, 0)...)      //默认微秒
+		data = append(data, pcapngIDB(order, linkTypeEthernet, 9)...) //纳秒
+		data = append(data, pcapngIDB(order, linkTypeRaw, 0x8a)...)   //2^-10秒
+		//名称解析等其他block跳过
+		data = append(data, pcapngBlock(order, 4, []byte{0, 0, 0, 0})...)
+		data = append(data, pcapngEPB(order, 0, 1700000000*1000000+250000, testIPv4Packet(1, 8080, 40))...)
+		data = append(data, pcapngEPB(order, 1, 1700000000*1000000000+1, testEthernetPacket(2, 8080, 40))...)
+		data = append(data, pcapngEPB(order, 2, 1700000000*1024+512, testIPv4Packet(3, 8080, 40))...)
+		//simple packet block属于第一个接口，沿用上一个报文的时间
+		spb := order.AppendUint32(nil, 40)
+		data = append(data, pcapngBlock(order, pcapngSPBType, append(spb, testIPv4Packet(4, 8080, 40)...))...)
+		//旧格式的packet block，接口号为16位
+		opb := order.AppendUint16(nil, 2)
+		opb = order.AppendUint16(opb, 0)
+		opb = order.AppendUint32(opb, uint32(1700000001*1024>>32))
+		opb = order.AppendUint32(opb, uint32(1700000001*1024&0xffffffff))
+		opb = order.AppendUint32(opb, 40)
+		opb = order.AppendUint32(opb, 40)
+		data = append(data, pcapngBlock(order, pcapngOPBType, append(opb, testIPv4Packet(6, 8080, 40)...))...)
+		//新的section重新编号接口
+		data = append(data, pcapngSHB(order)...)
+		data = append(data, pcapngIDB(order, linkTypeEthernet, 3)...)
+		data = append(data, pcapngEPB(order, 0, 1700000002*1000+5, testEthernetPacket(5, 8080, 40))...)
+
+		name := order.String()
+		packets := readAllPackets(t, data)
+		if len(packets) != 6 {
+			t.Fatalf("%s: %d packets, want 6", name, len(packets))
+		}
+		checkPacket(t, name+" micro", packets[0], time.Unix(1700000000, 250000000), linkTypeRaw, 1)
+		checkPacket(t, name+" nano", packets[1], time.Unix(1700000000, 1), linkTypeEthernet, 2)
+		checkPacket(t, name+" binary", packets[2], time.Unix(1700000000, 500000000), linkTypeRaw, 3)
+		checkPacket(t, name+" simple", packets[3], time.Unix(1700000000, 500000000), linkTypeRaw, 4)
+		checkPacket(t, name+" obsolete", packets[4], time.Unix(1700000001, 0), linkTypeRaw, 6)
+		checkPacket(t, name+" second section", packets[5], time.Unix(1700000002, 5000000), linkTypeEthernet, 5)
+	}
+}
+
+func TestCaptureErrors(t *testing.T) {
+	valid := buildPcap(binary.LittleEndian, pcapMagicMicro, linkTypeRaw, []testCapturePacket{{1700000000, 0, testIPv4Packet(1, 2, 40)}})
+	ng := append(pcapngSHB(binary.LittleEndian), pcapngIDB(binary.LittleEndian, linkTypeRaw, 0)...)
+	tests := []struct {
+		name string
+		data []byte
+		open bool //文件头可以识别
+	}{
+		{"unknown format", []byte("not a capture file"), false},
+		{"empty", nil, false},
+		{"truncated record", valid[:len(valid)-10], true},
+		{"truncated record header", valid[:24+8], true},
+		{"packet of unknown interface", append(append([]byte{}, ng...), pcapngEPB(binary.LittleEndian, 3, 0, testIPv4Packet(1, 2, 40))...), true},
+		{"block before section header", pcapngIDB(binary.LittleEndian, linkTypeRaw, 0), false},
+		{"truncated block", append(append([]byte{}, ng...), pcapngEPB(binary.LittleEndian, 0, 0, testIPv4Packet(1, 2, 40))[:30]...), true},
+	}
+	for _, test := range tests {
+		reader, err := openCapture(bytes.NewReader(test.data))
+		if (err == nil) != test.open {
+			t.Errorf("%s: open err = %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for {
+			_, err = reader.next()
+			if err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			t.Errorf("%s: no error before EOF", test.name)
+		}
+	}
+}
+
+func TestPcapngTimeRate(t *testing.T) {
+	tests := []struct {
+		resolution byte
+		rate       uint64
+	}{
+		{0, 1},
+		{3, 1000},
+		{6, 1000000},
+		{9, 1000000000},
+		{0x80, 1},
+		{0x8a, 1024},
+		{0x94, 1 << 20},
+	}
+	for _, test := range tests {
+		if rate := pcapngTimeRate(test.resolution); rate != test.rate {
+			t.Errorf("pcapngTimeRate(%#x) = %d, want %d", test.resolution, rate, test.rate)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//支持采集的协议及其IP协议号
+var protoNumbers = map[string]uint8{
+	"tcp":  6,
+	"udp":  17,
+	"sctp": 132,
+}
+
+//IP协议号对应的协议名，不支持的协议返回空
+func protoName(number uint8) string {
+	for name, n := range protoNumbers {
+		if n == number {
+			return name
+		}
+	}
+	return ""
+}
+
+//带协议的端口，如 udp/53，不带协议时默认为tcp
+type portSpec struct {
+	proto string
+	port  int
+}
+
+func (spec portSpec) String() string {
+	return spec.proto + "/" + strconv.Itoa(spec.port)
+}
+
+//解析单个端口配置
+func parsePortSpec(text string) (portSpec, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	proto, portStr := "tcp", text
+	if i := strings.IndexByte(text, '/'); i >= 0 {
+		proto, portStr = text[:i], text[i+1:]
+	}
+
+	if _, ok := protoNumbers[proto]; !ok {
+		return portSpec{}, fmt.Errorf("unsupported protocol[%s] in port[%s]", proto, text)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return portSpec{}, fmt.Errorf("invalid port[%s]", text)
+	}
+	return portSpec{proto: proto, port: port}, nil
+}
+
+//解析-ports参数，如 udp/53,tcp/443,sctp/3868，非法项跳过，重复项去重
+func parsePortsList(text string) ([]portSpec, []error) {
+	var portsList []portSpec
+	var errs []error
+	seen := make(map[portSpec]bool)
+	for _, item := range strings.Split(text, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		spec, err := parsePortSpec(item)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if seen[spec] {
+			continue
+		}
+		seen[spec] = true
+		portsList = append(portsList, spec)
+	}
+	return portsList, errs
+}
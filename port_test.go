@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortSpec(t *testing.T) {
+	tests := []struct {
+		text string
+		spec portSpec
+		ok   bool
+	}{
+		{"8080", portSpec{"tcp", 8080}, true},
+		{" 443 ", portSpec{"tcp", 443}, true},
+		{"udp/53", portSpec{"udp", 53}, true},
+		{"UDP/53", portSpec{"udp", 53}, true},
+		{"Sctp/3868", portSpec{"sctp", 3868}, true},
+		{"tcp/1", portSpec{"tcp", 1}, true},
+		{"tcp/65535", portSpec{"tcp", 65535}, true},
+		{"icmp/8", portSpec{}, false},
+		{"/80", portSpec{}, false},
+		{"tcp/", portSpec{}, false},
+		{"0", portSpec{}, false},
+		{"udp/0", portSpec{}, false},
+		{"65536", portSpec{}, false},
+		{"-1", portSpec{}, false},
+		{"http", portSpec{}, false},
+		{"tcp/80/90", portSpec{}, false},
+	}
+	for _, test := range tests {
+		spec, err := parsePortSpec(test.text)
+		if (err == nil) != test.ok || spec != test.spec {
+			t.Errorf("parsePortSpec(%q) = %v, %v", test.text, spec, err)
+		}
+	}
+}
+
+func TestParsePortsList(t *testing.T) {
+	portsList, errs := parsePortsList("8080, tcp/8080,udp/53,UDP/53,,icmp/1,65536,tcp/443")
+	want := []portSpec{{"tcp", 8080}, {"udp", 53}, {"tcp", 443}}
+	if !reflect.DeepEqual(portsList, want) {
+		t.Errorf("ports = %v, want %v", portsList, want)
+	}
+	if len(errs) != 2 {
+		t.Errorf("errors = %v, want 2", errs)
+	}
+
+	if portsList, errs := parsePortsList(""); portsList != nil || errs != nil {
+		t.Errorf("empty list = %v, %v", portsList, errs)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//流量输出，每条采集结果都会交给已启用的输出
+type Sink interface {
+	//输出一条流量记录
+	Write(flow *RootNetFlow) error
+	//关闭输出，刷新未写完的数据
+	Close() error
+}
+
+//输出的配置，每种输出一份，命令行参数直接绑定到sinkFlags中
+type sinkConfig struct {
+	interfaces bool //开启了-interfaces，记录中带有网卡流量
+
+	file     fileSinkConfig
+	influx   influxConfig
+	statsd   statsdConfig
+	otlp     otlpConfig
+	graphite graphiteConfig
+	netflow  netflowExportConfig
+}
+
+var (
+	sinkFactories = make(map[string]func(config *sinkConfig) (Sink, error))
+
+	//命令行参数对应的输出配置
+	sinkFlags = &sinkConfig{}
+)
+
+//注册流量输出
+func RegisterSink(name string, factory func(config *sinkConfig) (Sink, error)) {
+	if _, ok := sinkFactories[name]; ok {
+		panic(fmt.Sprintf("sink[%s] already registered", name))
+	}
+	sinkFactories[name] = factory
+}
+
+//根据名称创建流量输出
+func NewSink(name string, config *sinkConfig) (Sink, error) {
+	factory, ok := sinkFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sink[%s], available: %s", name, strings.Join(SinkNames(), ","))
+	}
+	return factory(config)
+}
+
+//已注册的流量输出名称
+func SinkNames() []string {
+	var names []string
+	for name := range sinkFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ------------  分发 ---------------
+
+//每个输出独占一个缓冲队列和协程，慢的输出只会丢自己的数据，不会阻塞其他输出
+type sinkWorker struct {
+	name    string
+	sink    Sink
+	queue   chan *RootNetFlow
+	dropped uint64
+	errors  uint64
+	done    chan struct{}
+}
+
+func (worker *sinkWorker) run() {
+	defer close(worker.done)
+	for flow := range worker.queue {
+		if err := worker.sink.Write(flow); err != nil {
+			atomic.AddUint64(&worker.errors, 1)
+			LOG_ERROR_F("sink[%s] write fail: %v", worker.name, err)
+		}
+	}
+}
+
+//把流量记录分发给所有输出
+type sinkDispatcher struct {
+	mux     sync.RWMutex
+	closed  bool
+	workers []*sinkWorker
+}
+
+//按名称列表创建输出，如 log,jsonl
+func newSinkDispatcher(names []string, bufferSize int, config *sinkConfig) (*sinkDispatcher, error) {
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+
+	dispatcher := &sinkDispatcher{}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		sink, err := NewSink(name, config)
+		if err != nil {
+			dispatcher.Close()
+			return nil, err
+		}
+
+		dispatcher.add(name, sink, bufferSize)
+		LOG_INFO_F("enable sink: %s", name)
+	}
+	return dispatcher, nil
+}
+
+//为输出启动独立的队列和协程
+func (dispatcher *sinkDispatcher) add(name string, sink Sink, bufferSize int) *sinkWorker {
+	worker := &sinkWorker{
+		name:  name,
+		sink:  sink,
+		queue: make(chan *RootNetFlow, bufferSize),
+		done:  make(chan struct{}),
+	}
+	go worker.run()
+	dispatcher.workers = append(dispatcher.workers, worker)
+	return worker
+}
+
+//分发一条记录，输出的队列满时丢弃
+func (dispatcher *sinkDispatcher) dispatch(flow *RootNetFlow) {
+	dispatcher.mux.RLock()
+	defer dispatcher.mux.RUnlock()
+
+	if dispatcher.closed {
+		return
+	}
+
+	for _, worker := range dispatcher.workers {
+		select {
+		case worker.queue <- flow:
+		default:
+			if atomic.AddUint64(&worker.dropped, 1)%100 == 1 {
+				LOG_WARN_F("sink[%s] is too slow, drop flow (dropped %d)", worker.name, atomic.LoadUint64(&worker.dropped))
+			}
+		}
+	}
+}
+
+//分发一条记录，输出的队列满时等待，用于离线分析等不能丢数据的场景
+func (dispatcher *sinkDispatcher) dispatchWait(flow *RootNetFlow) {
+	dispatcher.mux.RLock()
+	defer dispatcher.mux.RUnlock()
+
+	if dispatcher.closed {
+		return
+	}
+
+	for _, worker := range dispatcher.workers {
+		worker.queue <- flow
+	}
+}
+
+//关闭所有输出，等待队列中的数据写完
+func (dispatcher *sinkDispatcher) Close() {
+	dispatcher.mux.Lock()
+	if dispatcher.closed {
+		dispatcher.mux.Unlock()
+		return
+	}
+	dispatcher.closed = true
+	dispatcher.mux.Unlock()
+
+	for _, worker := range dispatcher.workers {
+		close(worker.queue)
+		<-worker.done
+		if err := worker.sink.Close(); err != nil {
+			LOG_ERROR_F("sink[%s] close fail: %v", worker.name, err)
+		}
+	}
+}
+
+// ------------  日志输出 ---------------
+
+//以日志的形式输出，原有的默认方式
+type logSink struct{}
+
+func init() {
+	RegisterSink("log", func(config *sinkConfig) (Sink, error) {
+		return &logSink{}, nil
+	})
+}
+
+func (s *logSink) Write(flow *RootNetFlow) error {
+	LOG_INFO_F("receive a flow: %v", flow)
+	return nil
+}
+
+func (s *logSink) Close() error {
+	return nil
+}
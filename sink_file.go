@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//jsonl和csv输出的配置，轮转参数两者共用
+type fileSinkConfig struct {
+	jsonlPath   string
+	csvPath     string
+	csvIfPath   string
+	maxSize     int64
+	rotateEvery time.Duration
+	compress    bool
+	maxBackups  int
+}
+
+func init() {
+	flags := &sinkFlags.file
+	flagSet.StringVar(&flags.jsonlPath, "jsonl.path", "./netflow.jsonl", "file of the jsonl sink")
+	flagSet.StringVar(&flags.csvPath, "csv.path", "./netflow.csv", "file of the csv sink")
+	flagSet.StringVar(&flags.csvIfPath, "csv.interfacePath", "./netflow_interfaces.csv", "file of the interface rows of the csv sink (with -interfaces)")
+	flagSet.Int64Var(&flags.maxSize, "file.maxSize", 100*1024*1024, "rotate file sinks when the file is larger than this (bytes), 0 to disable")
+	flagSet.DurationVar(&flags.rotateEvery, "file.rotate", 24*time.Hour, "rotate file sinks every duration, 0 to disable")
+	flagSet.BoolVar(&flags.compress, "file.compress", true, "gzip rotated files")
+	flagSet.IntVar(&flags.maxBackups, "file.maxBackups", 7, "rotated files to keep, 0 to keep all")
+
+	RegisterSink("jsonl", func(config *sinkConfig) (Sink, error) {
+		file, err := openRotateFile(config.file.jsonlPath, nil, &config.file)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonlSink{file: file}, nil
+	})
+
+	RegisterSink("csv", func(config *sinkConfig) (Sink, error) {
+		file, err := openRotateFile(config.file.csvPath, csvRow(csvHeader), &config.file)
+		if err != nil {
+			return nil, err
+		}
+		s := &csvSink{file: file}
+		//网卡的列不同，开启-interfaces时写到单独的文件
+		if config.interfaces {
+			if s.ifFile, err = openRotateFile(config.file.csvIfPath, csvRow(csvInterfaceHeader), &config.file); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		return s, nil
+	})
+}
+
+// ------------  jsonl ---------------
+
+//每条记录一行json
+type jsonlSink struct {
+	file *rotateFile
+}
+
+func (s *jsonlSink) Write(flow *RootNetFlow) error {
+	data, err := json.Marshal(flow)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+func (s *jsonlSink) Close() error {
+	return s.file.Close()
+}
+
+// ------------  csv ---------------
+
+//每个端口一行，新文件的第一行为表头
+type csvSink struct {
+	file   *rotateFile
+	ifFile *rotateFile //每个网卡一行，未开启-interfaces时为nil
+}
+
+var csvHeader = []string{
+	"timestamp", "window_start", "window_end", "port", "protocol",
+	"in_bytes", "out_bytes", "in_packets", "out_packets",
+	"in_rate", "out_rate", "in_packet_rate", "out_packet_rate", "partial",
+}
+
+var csvInterfaceHeader = []string{
+	"timestamp", "window_start", "window_end", "interface",
+	"rx_bytes", "tx_bytes", "rx_packets", "tx_packets",
+	"rx_errors", "tx_errors", "rx_drops", "tx_drops",
+	"rx_rate", "tx_rate", "partial",
+}
+
+func csvRow(fields []string) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(fields)
+	w.Flush()
+	return buf.Bytes()
+}
+
+func (s *csvSink) Write(flow *RootNetFlow) error {
+	var buf bytes.Buffer
+	for _, pf := range flow.Ports {
+		buf.Write(csvRow([]string{
+			strconv.FormatInt(flow.Timestamp, 10),
+			strconv.FormatInt(flow.WindowStart, 10),
+			strconv.FormatInt(flow.WindowEnd, 10),
+			strconv.Itoa(pf.Port),
+			pf.Protocol,
+			strconv.FormatInt(pf.InBytes, 10),
+			strconv.FormatInt(pf.OutBytes, 10),
+			strconv.FormatInt(pf.InPackets, 10),
+			strconv.FormatInt(pf.OutPackets, 10),
+			strconv.FormatFloat(pf.InRate, 'f', 3, 64),
+			strconv.FormatFloat(pf.OutRate, 'f', 3, 64),
+			strconv.FormatFloat(pf.InPacketRate, 'f', 3, 64),
+			strconv.FormatFloat(pf.OutPacketRate, 'f', 3, 64),
+			strconv.FormatBool(pf.Partial),
+		}))
+	}
+	if buf.Len() > 0 {
+		//一条记录的所有行一次写入，保证不会被轮转拆到两个文件
+		if _, err := s.file.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if s.ifFile == nil || len(flow.Interfaces) == 0 {
+		return nil
+	}
+
+	buf.Reset()
+	for _, ifc := range flow.Interfaces {
+		buf.Write(csvRow([]string{
+			strconv.FormatInt(flow.Timestamp, 10),
+			strconv.FormatInt(flow.WindowStart, 10),
+			strconv.FormatInt(flow.WindowEnd, 10),
+			ifc.Name,
+			strconv.FormatInt(ifc.RxBytes, 10),
+			strconv.FormatInt(ifc.TxBytes, 10),
+			strconv.FormatInt(ifc.RxPackets, 10),
+			strconv.FormatInt(ifc.TxPackets, 10),
+			strconv.FormatInt(ifc.RxErrors, 10),
+			strconv.FormatInt(ifc.TxErrors, 10),
+			strconv.FormatInt(ifc.RxDrops, 10),
+			strconv.FormatInt(ifc.TxDrops, 10),
+			strconv.FormatFloat(ifc.RxRate, 'f', 3, 64),
+			strconv.FormatFloat(ifc.TxRate, 'f', 3, 64),
+			strconv.FormatBool(ifc.Partial),
+		}))
+	}
+	_, err := s.ifFile.Write(buf.Bytes())
+	return err
+}
+
+func (s *csvSink) Close() error {
+	err := s.file.Close()
+	if s.ifFile != nil {
+		if ifErr := s.ifFile.Close(); err == nil {
+			err = ifErr
+		}
+	}
+	return err
+}
+
+// ------------  文件轮转 ---------------
+
+//按大小或时间轮转的文件，轮转后的文件名为 <path>.<时间>，可选gzip压缩
+type rotateFile struct {
+	mux        sync.Mutex
+	path       string
+	header     []byte //新文件的第一行，如csv表头
+	maxSize    int64
+	every      time.Duration
+	compress   bool
+	maxBackups int
+
+	file        *os.File
+	size        int64
+	nextRotate  time.Time
+	background  sync.WaitGroup  //压缩和清理
+	compressing map[string]bool //正在压缩的轮转文件名（不含目录），清理时跳过
+}
+
+func openRotateFile(path string, header []byte, config *fileSinkConfig) (*rotateFile, error) {
+	rf := &rotateFile{
+		path:        path,
+		header:      header,
+		maxSize:     config.maxSize,
+		every:       config.rotateEvery,
+		compress:    config.compress,
+		maxBackups:  config.maxBackups,
+		compressing: make(map[string]bool),
+	}
+	if dir := filepath.Dir(path); !PathFileExists(dir) {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotateFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	if rf.every > 0 {
+		rf.nextRotate = time.Now().Truncate(rf.every).Add(rf.every)
+	}
+
+	if rf.size == 0 && len(rf.header) > 0 {
+		n, err := rf.file.Write(rf.header)
+		rf.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rf *rotateFile) Write(p []byte) (int, error) {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	//空文件不轮转，避免单条记录超过maxSize时反复生成空文件
+	if rf.size > int64(len(rf.header)) {
+		bySize := rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize
+		byTime := rf.every > 0 && !time.Now().Before(rf.nextRotate)
+		if bySize || byTime {
+			if err := rf.rotate(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotateFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		LOG_ERROR(err)
+	}
+	rf.file = nil
+
+	//改名失败时重新打开原文件继续写，下次再尝试轮转
+	backup := rf.backupName()
+	if err := os.Rename(rf.path, backup); err != nil {
+		LOG_ERROR_F("rotate %s fail: %v", rf.path, err)
+		return rf.open()
+	}
+	LOG_INFO_F("rotate %s -> %s", rf.path, backup)
+
+	if rf.compress {
+		rf.compressing[filepath.Base(backup)] = true
+	}
+	rf.background.Add(1)
+	go func() {
+		defer rf.background.Done()
+		if rf.compress {
+			if err := gzipFile(backup); err != nil {
+				LOG_ERROR_F("compress %s fail: %v", backup, err)
+			}
+			rf.mux.Lock()
+			delete(rf.compressing, filepath.Base(backup))
+			rf.mux.Unlock()
+		}
+		rf.removeOldBackups()
+	}()
+
+	return rf.open()
+}
+
+//轮转文件名中的时间格式
+const backupTimeLayout = "20060102-150405"
+
+//轮转后的文件名，同一秒内多次轮转时加序号
+func (rf *rotateFile) backupName() string {
+	base := rf.path + "." + time.Now().Format(backupTimeLayout)
+	name := base
+	for i := 1; PathFileExists(name) || PathFileExists(name+".gz"); i++ {
+		name = fmt.Sprintf("%s.%d", base, i)
+	}
+	return name
+}
+
+//轮转文件名中的时间和序号
+type backupInfo struct {
+	path string
+	time time.Time
+	seq  int
+}
+
+//按backupName的格式解析 <file>.<YYYYMMDD-HHMMSS>[.N][.gz]，name不含目录，其他文件返回false
+func (rf *rotateFile) parseBackupName(name string) (*backupInfo, bool) {
+	prefix := filepath.Base(rf.path) + "."
+	if !strings.HasPrefix(name, prefix) {
+		return nil, false
+	}
+	rest := strings.TrimSuffix(name[len(prefix):], ".gz")
+
+	stamp, seqText := rest, ""
+	if i := strings.IndexByte(rest, '.'); i >= 0 {
+		stamp, seqText = rest[:i], rest[i+1:]
+	}
+	if len(stamp) != len(backupTimeLayout) {
+		return nil, false
+	}
+	t, err := time.ParseInLocation(backupTimeLayout, stamp, time.Local)
+	if err != nil {
+		return nil, false
+	}
+	info := &backupInfo{path: filepath.Join(filepath.Dir(rf.path), name), time: t}
+	if rest != stamp {
+		seq, err := strconv.Atoi(seqText)
+		if err != nil || seq <= 0 || strconv.Itoa(seq) != seqText {
+			return nil, false
+		}
+		info.seq = seq
+	}
+	return info, true
+}
+
+//只保留最新的maxBackups个轮转文件，只认backupName生成的文件名，正在压缩的文件不参与
+func (rf *rotateFile) removeOldBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(rf.path))
+	if err != nil {
+		LOG_ERROR(err)
+		return
+	}
+
+	rf.mux.Lock()
+	var backups []*backupInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || rf.compressing[name] || rf.compressing[strings.TrimSuffix(name, ".gz")] {
+			continue
+		}
+		if info, ok := rf.parseBackupName(name); ok {
+			backups = append(backups, info)
+		}
+	}
+	rf.mux.Unlock()
+	if len(backups) <= rf.maxBackups {
+		return
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].time.Equal(backups[j].time) {
+			return backups[i].time.Before(backups[j].time)
+		}
+		return backups[i].seq < backups[j].seq
+	})
+	for _, backup := range backups[:len(backups)-rf.maxBackups] {
+		if err := os.Remove(backup.path); err != nil {
+			LOG_ERROR(err)
+		}
+	}
+}
+
+func (rf *rotateFile) Close() error {
+	rf.mux.Lock()
+	var err error
+	if rf.file != nil {
+		err = rf.file.Close()
+		rf.file = nil
+	}
+	rf.mux.Unlock()
+
+	rf.background.Wait()
+	return err
+}
+
+//压缩为 <path>.gz 并删除原文件，先写到临时文件，写完再改名，不会留下不完整的.gz
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
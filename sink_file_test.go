@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseBackupName(t *testing.T) {
+	rf := &rotateFile{path: "/var/log/flows.jsonl"}
+	tests := []struct {
+		name string
+		ok   bool
+		seq  int
+	}{
+		{"flows.jsonl.20240312-102107", true, 0},
+		{"flows.jsonl.20240312-102107.gz", true, 0},
+		{"flows.jsonl.20240312-102107.3", true, 3},
+		{"flows.jsonl.20240312-102107.12.gz", true, 12},
+		{"flows.jsonl", false, 0},
+		{"flows.jsonl.bak", false, 0},
+		{"flows.jsonl.gz", false, 0},
+		{"flows.jsonl.20240312-102107.gz.tmp", false, 0},
+		{"flows.jsonl.20240312-102107.0", false, 0},
+		{"flows.jsonl.20240312-102107.03", false, 0},
+		{"flows.jsonl.20240312-102107.x", false, 0},
+		{"flows.jsonl.20241312-102107", false, 0},
+		{"flows.jsonl.2024031-102107", false, 0},
+		{"other.jsonl.20240312-102107", false, 0},
+	}
+	for _, test := range tests {
+		info, ok := rf.parseBackupName(test.name)
+		if ok != test.ok {
+			t.Errorf("parse %s = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if ok && (info.seq != test.seq || info.path != filepath.Join("/var/log", test.name)) {
+			t.Errorf("parse %s = %+v", test.name, info)
+		}
+	}
+}
+
+func TestRemoveOldBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"flows.jsonl",
+		"flows.jsonl.bak",
+		"flows.jsonl.old.gz",
+		"flows.jsonl.20240312-102107.gz",
+		"flows.jsonl.20240312-102107.2.gz",
+		"flows.jsonl.20240312-102107.10.gz",
+		"flows.jsonl.20240312-112107.gz",
+		"flows.jsonl.20240312-122107",
+		"flows.jsonl.20240312-122107.gz.tmp",
+		"flows.csv.20240312-102107",
+	}
+	for _, name := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rf := &rotateFile{
+		path:        filepath.Join(dir, "flows.jsonl"),
+		maxBackups:  2,
+		compressing: map[string]bool{"flows.jsonl.20240312-122107": true},
+	}
+	rf.removeOldBackups()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	//序号按数字比较，.10在.2之后；正在压缩的文件不计数也不删除
+	want := []string{
+		"flows.csv.20240312-102107",
+		"flows.jsonl",
+		"flows.jsonl.20240312-102107.10.gz",
+		"flows.jsonl.20240312-112107.gz",
+		"flows.jsonl.20240312-122107",
+		"flows.jsonl.20240312-122107.gz.tmp",
+		"flows.jsonl.bak",
+		"flows.jsonl.old.gz",
+	}
+	sort.Strings(left)
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("left = %q, want %q", left, want)
+	}
+}
+
+//目录下的文件名和内容
+func readDirFiles(t *testing.T, dir string) map[string]string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func TestRotateFileWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "flows.csv")
+	rf, err := openRotateFile(path, []byte("h\n"), &fileSinkConfig{maxSize: 7, rotateEvery: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	write := func(line string) {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("write %q: %v", line, err)
+		}
+	}
+
+	//按大小：表头2字节+3字节，再写3字节超过7字节
+	write("a1\n")
+	write("a2\n")
+	files := readDirFiles(t, dir)
+	if len(files) != 2 || files["flows.csv"] != "h\na2\n" {
+		t.Fatalf("after size rotation: %q", files)
+	}
+	for name, data := range files {
+		if name != "flows.csv" && data != "h\na1\n" {
+			t.Errorf("backup %s = %q", name, data)
+		}
+	}
+
+	//按时间：到了轮转时间即使没满也轮转
+	rf.nextRotate = time.Now().Add(-time.Second)
+	write("b1\n")
+	if files = readDirFiles(t, dir); len(files) != 3 || files["flows.csv"] != "h\nb1\n" {
+		t.Fatalf("after time rotation: %q", files)
+	}
+	if !rf.nextRotate.After(time.Now()) {
+		t.Errorf("next rotation %v not rescheduled", rf.nextRotate)
+	}
+
+	//改名失败（文件被删除）后重新打开继续写
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	rf.nextRotate = time.Now().Add(-time.Second)
+	write("d1\n")
+	write("d2\n")
+	files = readDirFiles(t, dir)
+	if len(files) != 4 || files["flows.csv"] != "h\nd2\n" {
+		t.Fatalf("after failed rotation: %q", files)
+	}
+	var reopened bool
+	for _, data := range files {
+		reopened = reopened || data == "h\nd1\n"
+	}
+	if !reopened {
+		t.Errorf("no backup of the reopened file: %q", files)
+	}
+}
+
+func TestGzipFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "flows.jsonl.20240312-102107")
+	if err := ioutil.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if PathFileExists(path) || PathFileExists(path+".gz.tmp") || !PathFileExists(path+".gz") {
+		t.Error("gzip should leave only the .gz file")
+	}
+}
+
+func TestCSVSinkInterfaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := *sinkFlags
+	config.interfaces = true
+	config.file.csvPath = filepath.Join(dir, "flows.csv")
+	config.file.csvIfPath = filepath.Join(dir, "interfaces.csv")
+
+	sink, err := NewSink("csv", &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}})
+	flow.Timestamp, flow.WindowStart, flow.WindowEnd = 2, 1000, 2000
+	flow.Interfaces = []*InterfaceNetFlow{{
+		Name: "eth0", RxBytes: 4000, TxBytes: 2000, RxPackets: 40, TxPackets: 20,
+		RxErrors: 1, TxErrors: 2, RxDrops: 3, TxDrops: 4, RxRate: 4000, TxRate: 2000,
+	}}
+	if err := sink.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(config.file.csvIfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := string(csvRow(csvInterfaceHeader)) + "2,1000,2000,eth0,4000,2000,40,20,1,2,3,4,4000.000,2000.000,false\n"
+	if string(data) != want {
+		t.Errorf("interface csv = %q, want %q", data, want)
+	}
+	if data, _ := ioutil.ReadFile(config.file.csvPath); len(bytes.Split(bytes.TrimSpace(data), []byte("\n"))) != 2 {
+		t.Errorf("port csv = %q", data)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type graphiteConfig struct {
+	addr      string
+	protocol  string
+	prefix    string
+	queueSize int
+}
+
+const (
+	graphiteDialTimeout  = 5 * time.Second
+	graphiteWriteTimeout = 10 * time.Second
+	graphiteMaxBackoff   = 30 * time.Second
+)
+
+func init() {
+	flags := &sinkFlags.graphite
+	flagSet.StringVar(&flags.addr, "graphite.addr", "127.0.0.1:2003", "carbon address, usually 2003 for plaintext and 2004 for pickle")
+	flagSet.StringVar(&flags.protocol, "graphite.protocol", "plaintext", "carbon protocol: plaintext|pickle")
+	flagSet.StringVar(&flags.prefix, "graphite.prefix", "netflow", "prefix of the graphite metric paths")
+	flagSet.IntVar(&flags.queueSize, "graphite.queueSize", 10000, "metrics kept in memory while carbon is down, oldest are dropped")
+
+	RegisterSink("graphite", func(config *sinkConfig) (Sink, error) {
+		return newGraphiteSink(&config.graphite)
+	})
+}
+
+type graphiteMetric struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+//通过tcp写入carbon，指标路径如 netflow.<host>.<port>.in_bytes
+//Write只放入内存队列，由后台协程发送，carbon不可用时自动重连，队列满时丢弃最旧的数据
+type graphiteSink struct {
+	mux     sync.Mutex
+	queue   []graphiteMetric
+	dropped uint64
+
+	addr     string
+	pickle   bool
+	prefix   string
+	maxQueue int
+	conn     net.Conn
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newGraphiteSink(config *graphiteConfig) (*graphiteSink, error) {
+	s := &graphiteSink{
+		addr:     config.addr,
+		maxQueue: config.queueSize,
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	switch config.protocol {
+	case "plaintext":
+	case "pickle":
+		s.pickle = true
+	default:
+		return nil, fmt.Errorf("unsupported graphite.protocol[%s], available: plaintext,pickle", config.protocol)
+	}
+	if s.maxQueue <= 0 {
+		s.maxQueue = 1
+	}
+
+	host := "unknown"
+	if hostname, err := os.Hostname(); err == nil {
+		host = hostname
+	}
+	s.prefix = strings.TrimSuffix(config.prefix, ".") + "." + graphiteNode(host)
+
+	go s.sendLoop()
+	return s, nil
+}
+
+//路径中的一级，点和空白替换为下划线
+func graphiteNode(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == ' ' || r == '\t' || r == '\n' {
+			return '_'
+		}
+		return r
+	}, text)
+}
+
+func (s *graphiteSink) Write(flow *RootNetFlow) error {
+	var metrics []graphiteMetric
+	for _, pf := range flow.Ports {
+		//tcp端口只用端口号，其他协议加上协议名，如 udp_53
+		node := strconv.Itoa(pf.Port)
+		if pf.Protocol != "tcp" {
+			node = pf.Protocol + "_" + node
+		}
+		path := s.prefix + "." + node + "."
+		metrics = append(metrics,
+			graphiteMetric{path + "in_bytes", float64(pf.InBytes), flow.Timestamp},
+			graphiteMetric{path + "out_bytes", float64(pf.OutBytes), flow.Timestamp},
+			graphiteMetric{path + "in_packets", float64(pf.InPackets), flow.Timestamp},
+			graphiteMetric{path + "out_packets", float64(pf.OutPackets), flow.Timestamp},
+		)
+	}
+	//网卡如 netflow.<host>.interface.eth0.rx_bytes
+	for _, ifc := range flow.Interfaces {
+		path := s.prefix + ".interface." + graphiteNode(ifc.Name) + "."
+		metrics = append(metrics,
+			graphiteMetric{path + "rx_bytes", float64(ifc.RxBytes), flow.Timestamp},
+			graphiteMetric{path + "tx_bytes", float64(ifc.TxBytes), flow.Timestamp},
+			graphiteMetric{path + "rx_packets", float64(ifc.RxPackets), flow.Timestamp},
+			graphiteMetric{path + "tx_packets", float64(ifc.TxPackets), flow.Timestamp},
+			graphiteMetric{path + "rx_errors", float64(ifc.RxErrors), flow.Timestamp},
+			graphiteMetric{path + "tx_errors", float64(ifc.TxErrors), flow.Timestamp},
+			graphiteMetric{path + "rx_drops", float64(ifc.RxDrops), flow.Timestamp},
+			graphiteMetric{path + "tx_drops", float64(ifc.TxDrops), flow.Timestamp},
+		)
+	}
+
+	s.mux.Lock()
+	s.enqueue(metrics, false)
+	s.mux.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//加入队列，front为true时放在队头（发送失败的数据），超过上限丢弃最旧的
+func (s *graphiteSink) enqueue(metrics []graphiteMetric, front bool) {
+	if front {
+		s.queue = append(metrics, s.queue...)
+	} else {
+		s.queue = append(s.queue, metrics...)
+	}
+	if over := len(s.queue) - s.maxQueue; over > 0 {
+		s.queue = append([]graphiteMetric(nil), s.queue[over:]...)
+		s.dropped += uint64(over)
+		LOG_WARN_F("graphite queue is full, drop %d metrics (dropped %d)", over, s.dropped)
+	}
+}
+
+func (s *graphiteSink) sendLoop() {
+	defer close(s.done)
+	backoff := time.Second
+	for {
+		select {
+		case <-s.notify:
+		case <-s.stop:
+			//退出前尽量发送剩余的数据
+			if err := s.send(); err != nil {
+				LOG_ERROR_F("graphite flush fail: %v", err)
+			}
+			if s.conn != nil {
+				s.conn.Close()
+			}
+			return
+		}
+
+		if err := s.send(); err != nil {
+			LOG_WARN_F("graphite send fail, retry in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+			}
+			if backoff *= 2; backoff > graphiteMaxBackoff {
+				backoff = graphiteMaxBackoff
+			}
+			//重试
+			select {
+			case s.notify <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+//发送队列中的所有数据，失败时放回队列并断开连接
+func (s *graphiteSink) send() error {
+	s.mux.Lock()
+	metrics := s.queue
+	s.queue = nil
+	s.mux.Unlock()
+
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	var err error
+	if s.conn == nil {
+		if s.conn, err = net.DialTimeout("tcp", s.addr, graphiteDialTimeout); err != nil {
+			s.conn = nil
+		} else {
+			LOG_INFO_F("graphite connected to %s", s.addr)
+		}
+	}
+	if err == nil {
+		var data []byte
+		if s.pickle {
+			data = encodeGraphitePickle(metrics)
+		} else {
+			data = encodeGraphitePlaintext(metrics)
+		}
+		_ = s.conn.SetWriteDeadline(time.Now().Add(graphiteWriteTimeout))
+		if _, err = s.conn.Write(data); err != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+	}
+
+	if err != nil {
+		s.mux.Lock()
+		s.enqueue(metrics, true)
+		s.mux.Unlock()
+	}
+	return err
+}
+
+func (s *graphiteSink) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.queue) > 0 {
+		return fmt.Errorf("graphite drop %d unsent metrics", len(s.queue))
+	}
+	return nil
+}
+
+//每行 <path> <value> <timestamp>
+func encodeGraphitePlaintext(metrics []graphiteMetric) []byte {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "%s %s %d\n", m.path, strconv.FormatFloat(m.value, 'f', -1, 64), m.timestamp)
+	}
+	return buf.Bytes()
+}
+
+//pickle协议：4字节长度 + pickle编码的 [(path, (timestamp, value)), ...]
+func encodeGraphitePickle(metrics []graphiteMetric) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0}) //长度，最后填入
+	buf.Write([]byte{0x80, 2})    //PROTO 2
+	buf.WriteByte(']')            //EMPTY_LIST
+	buf.WriteByte('(')            //MARK
+	for _, m := range metrics {
+		buf.WriteByte('X') //BINUNICODE
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(m.path)))
+		buf.WriteString(m.path)
+		buf.WriteByte('J') //BININT
+		_ = binary.Write(&buf, binary.LittleEndian, int32(m.timestamp))
+		buf.WriteByte('G') //BINFLOAT
+		_ = binary.Write(&buf, binary.BigEndian, math.Float64bits(m.value))
+		buf.WriteByte(0x86) //TUPLE2 (timestamp, value)
+		buf.WriteByte(0x86) //TUPLE2 (path, (...))
+	}
+	buf.WriteByte('e') //APPENDS
+	buf.WriteByte('.') //STOP
+
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return data
+}
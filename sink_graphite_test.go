@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGraphiteSinkMetrics(t *testing.T) {
+	s := &graphiteSink{prefix: "netflow.node1", maxQueue: 100, notify: make(chan struct{}, 1)}
+	flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}, {proto: "udp", port: 53}})
+	flow.Timestamp = 1700000000
+	flow.Ports[0].InBytes, flow.Ports[1].OutPackets = 100, 2
+	flow.Interfaces = []*InterfaceNetFlow{{
+		Name: "eth0.100", RxBytes: 4000, TxBytes: 2000, RxPackets: 40, TxPackets: 20,
+		RxErrors: 1, TxErrors: 2, RxDrops: 3, TxDrops: 4,
+	}}
+	if err := s.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := make(map[string]float64)
+	for _, metric := range s.queue {
+		if metric.timestamp != flow.Timestamp {
+			t.Errorf("%s timestamp = %d", metric.path, metric.timestamp)
+		}
+		metrics[metric.path] = metric.value
+	}
+	want := map[string]float64{
+		"netflow.node1.8080.in_bytes":                 100,
+		"netflow.node1.8080.out_bytes":                0,
+		"netflow.node1.8080.in_packets":               0,
+		"netflow.node1.8080.out_packets":              0,
+		"netflow.node1.udp_53.in_bytes":               0,
+		"netflow.node1.udp_53.out_bytes":              0,
+		"netflow.node1.udp_53.in_packets":             0,
+		"netflow.node1.udp_53.out_packets":            2,
+		"netflow.node1.interface.eth0_100.rx_bytes":   4000,
+		"netflow.node1.interface.eth0_100.tx_bytes":   2000,
+		"netflow.node1.interface.eth0_100.rx_packets": 40,
+		"netflow.node1.interface.eth0_100.tx_packets": 20,
+		"netflow.node1.interface.eth0_100.rx_errors":  1,
+		"netflow.node1.interface.eth0_100.tx_errors":  2,
+		"netflow.node1.interface.eth0_100.rx_drops":   3,
+		"netflow.node1.interface.eth0_100.tx_drops":   4,
+	}
+	if !reflect.DeepEqual(metrics, want) {
+		t.Errorf("metrics = %v, want %v", metrics, want)
+	}
+}
+
+func TestEncodeGraphitePickle(t *testing.T) {
+	data := encodeGraphitePickle([]graphiteMetric{
+		{"a.b", 1.5, 1700000000},
+		{"c", -2, 1},
+	})
+	want := []byte{
+		0, 0, 0, 52, //长度
+		0x80, 2, ']', '(',
+		'X', 3, 0, 0, 0, 'a', '.', 'b',
+		'J', 0x00, 0xf1, 0x53, 0x65, //1700000000，小端
+		'G', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, //1.5，大端
+		0x86, 0x86,
+		'X', 1, 0, 0, 0, 'c',
+		'J', 1, 0, 0, 0,
+		'G', 0xc0, 0, 0, 0, 0, 0, 0, 0, //-2
+		0x86, 0x86,
+		'e', '.',
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("pickle = % x\nwant     % x", data, want)
+	}
+
+	//空列表
+	if data := encodeGraphitePickle(nil); !bytes.Equal(data, []byte{0, 0, 0, 6, 0x80, 2, ']', '(', 'e', '.'}) {
+		t.Errorf("empty pickle = % x", data)
+	}
+}
+
+func TestGraphiteSinkReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	//第一个连接在建立后RST，第二个连接读到对方关闭为止
+	drop := make(chan struct{})
+	received := make(chan []byte, 1)
+	go func() {
+		first, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		<-drop
+		first.(*net.TCPConn).SetLinger(0)
+		first.Close()
+
+		second, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer second.Close()
+		data, _ := ioutil.ReadAll(second)
+		received <- data
+	}()
+
+	s := &graphiteSink{addr: listener.Addr().String(), maxQueue: 100, notify: make(chan struct{}, 1)}
+	if s.conn, err = net.Dial("tcp", s.addr); err != nil {
+		t.Fatal(err)
+	}
+	close(drop)
+	//等收到RST，之后的写入一定失败
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("first connection should be dropped")
+	}
+
+	s.enqueue([]graphiteMetric{{"m1", 1, 100}, {"m2", 2, 100}}, false)
+	if err := s.send(); err == nil {
+		t.Fatal("send on the dropped connection should fail")
+	}
+	if s.conn != nil || len(s.queue) != 2 {
+		t.Fatalf("after failure conn = %v, queue = %v", s.conn, s.queue)
+	}
+
+	//失败的数据在新数据之前重发
+	s.enqueue([]graphiteMetric{{"m3", 3, 160}}, false)
+	if err := s.send(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.queue) != 0 {
+		t.Errorf("queue = %v after reconnect", s.queue)
+	}
+	s.conn.Close()
+
+	select {
+	case data := <-received:
+		if want := "m1 1 100\nm2 2 100\nm3 3 160\n"; string(data) != want {
+			t.Errorf("received %q, want %q", data, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnection")
+	}
+}
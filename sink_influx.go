@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type influxConfig struct {
+	url           string
+	org           string
+	bucket        string
+	token         string
+	measurement   string
+	ifMeasurement string
+	tags          string
+	batchSize     int
+	flushInterval time.Duration
+	retries       int
+}
+
+//udp单个包的最大长度，避免ip分片
+const influxMaxUDPPayload = 1400
+
+func init() {
+	flags := &sinkFlags.influx
+	flagSet.StringVar(&flags.url, "influx.url", "http://127.0.0.1:8086", "influxdb address, http(s)://host:8086 for /api/v2/write or udp://host:8089")
+	flagSet.StringVar(&flags.org, "influx.org", "", "influxdb organization (http only)")
+	flagSet.StringVar(&flags.bucket, "influx.bucket", "netflow", "influxdb bucket (http only)")
+	flagSet.StringVar(&flags.token, "influx.token", "", "influxdb api token (http only)")
+	flagSet.StringVar(&flags.measurement, "influx.measurement", "netflow", "influxdb measurement name")
+	flagSet.StringVar(&flags.ifMeasurement, "influx.interfaceMeasurement", "netflow_interface", "influxdb measurement name of the interface points (with -interfaces)")
+	flagSet.StringVar(&flags.tags, "influx.tags", "", "extra tags added to every point, e.g. dc=sh,env=prod")
+	flagSet.IntVar(&flags.batchSize, "influx.batchSize", 500, "points per write")
+	flagSet.DurationVar(&flags.flushInterval, "influx.flushInterval", 10*time.Second, "max time points are kept before written")
+	flagSet.IntVar(&flags.retries, "influx.retries", 3, "retries of a failed write")
+
+	RegisterSink("influx", func(config *sinkConfig) (Sink, error) {
+		return newInfluxSink(&config.influx)
+	})
+}
+
+//以line protocol格式写入influxdb，按条数和时间批量发送，发送只在flushLoop中进行
+type influxSink struct {
+	mux           sync.Mutex
+	measurement   string
+	ifMeasurement string //网卡的点，字段与端口的不同
+	tags          string //已转义的公共tag，形如 ,host=a,dc=sh
+	batchSize     int
+	retries       int
+	flushInterval time.Duration //也是一批数据重试的总时长上限
+
+	lines   [][]byte
+	lastErr error //flushLoop上次发送的错误，由下一次Write返回
+
+	kick chan struct{} //攒满一批时通知flushLoop发送
+
+	//http或udp二选一
+	client   *http.Client
+	writeURL string
+	token    string
+	conn     net.Conn
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newInfluxSink(config *influxConfig) (*influxSink, error) {
+	u, err := url.Parse(config.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx.url: %v", err)
+	}
+
+	tags, err := parseTagList(config.tags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influx.tags: %v", err)
+	}
+	if _, ok := tags["host"]; !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			tags["host"] = hostname
+		}
+	}
+
+	s := &influxSink{
+		measurement:   escapeInflux(config.measurement, ", "),
+		ifMeasurement: escapeInflux(config.ifMeasurement, ", "),
+		tags:          formatInfluxTags(tags),
+		batchSize:     config.batchSize,
+		retries:       config.retries,
+		flushInterval: config.flushInterval,
+		kick:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 1
+	}
+	if s.flushInterval <= 0 {
+		s.flushInterval = 10 * time.Second
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		query := url.Values{}
+		query.Set("bucket", config.bucket)
+		if config.org != "" {
+			query.Set("org", config.org)
+		}
+		query.Set("precision", "ns")
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		u.RawQuery = query.Encode()
+		s.writeURL = u.String()
+		s.token = config.token
+		s.client = &http.Client{Timeout: 10 * time.Second}
+	case "udp":
+		if s.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported influx.url scheme[%s]", u.Scheme)
+	}
+
+	go s.flushLoop()
+	return s, nil
+}
+
+//每个端口一个点，另加一个port=all的合计点，开启-interfaces时每个网卡一个点
+func (s *influxSink) Write(flow *RootNetFlow) error {
+	ts := flow.WindowEnd * int64(time.Millisecond)
+
+	s.mux.Lock()
+	for _, pf := range flow.Ports {
+		tags := ",port=" + strconv.Itoa(pf.Port) + ",proto=" + escapeInflux(pf.Protocol, ",= ")
+		s.lines = append(s.lines, s.line(tags, pf.InBytes, pf.OutBytes, pf.InPackets, pf.OutPackets, pf.InRate, pf.OutRate, pf.Partial, ts))
+	}
+	s.lines = append(s.lines, s.line(",port=all,proto=all", flow.InBytes, flow.OutBytes, flow.InPackets, flow.OutPackets, flow.InRate, flow.OutRate, flow.Partial, ts))
+	for _, ifc := range flow.Interfaces {
+		s.lines = append(s.lines, s.interfaceLine(ifc, ts))
+	}
+	full := len(s.lines) >= s.batchSize
+	err := s.lastErr
+	s.lastErr = nil
+	s.mux.Unlock()
+
+	if full {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+func (s *influxSink) line(tags string, inBytes, outBytes, inPackets, outPackets int64, inRate, outRate float64, partial bool, ts int64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(s.measurement)
+	buf.WriteString(tags)
+	buf.WriteString(s.tags)
+	fmt.Fprintf(&buf, " in_bytes=%di,out_bytes=%di,in_packets=%di,out_packets=%di,in_rate=%s,out_rate=%s,partial=%t %d\n",
+		inBytes, outBytes, inPackets, outPackets,
+		strconv.FormatFloat(inRate, 'f', -1, 64), strconv.FormatFloat(outRate, 'f', -1, 64), partial, ts)
+	return buf.Bytes()
+}
+
+func (s *influxSink) interfaceLine(ifc *InterfaceNetFlow, ts int64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(s.ifMeasurement)
+	buf.WriteString(",interface=")
+	buf.WriteString(escapeInflux(ifc.Name, ",= "))
+	buf.WriteString(s.tags)
+	fmt.Fprintf(&buf, " rx_bytes=%di,tx_bytes=%di,rx_packets=%di,tx_packets=%di,rx_errors=%di,tx_errors=%di,rx_drops=%di,tx_drops=%di,rx_rate=%s,tx_rate=%s,partial=%t %d\n",
+		ifc.RxBytes, ifc.TxBytes, ifc.RxPackets, ifc.TxPackets, ifc.RxErrors, ifc.TxErrors, ifc.RxDrops, ifc.TxDrops,
+		strconv.FormatFloat(ifc.RxRate, 'f', -1, 64), strconv.FormatFloat(ifc.TxRate, 'f', -1, 64), ifc.Partial, ts)
+	return buf.Bytes()
+}
+
+//唯一的发送协程：定时或攒满一批时发送，退出前发送剩余的点
+func (s *influxSink) flushLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.kick:
+		case <-s.stop:
+			s.flush()
+			return
+		}
+		s.flush()
+	}
+}
+
+//按batchSize分批发送缓存的点，发送失败的批次丢弃，错误交给下一次Write返回
+func (s *influxSink) flush() {
+	s.mux.Lock()
+	lines := s.lines
+	s.lines = nil
+	s.mux.Unlock()
+
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > s.batchSize {
+			n = s.batchSize
+		}
+		if err := s.send(lines[:n]); err != nil {
+			LOG_ERROR_F("influx flush fail: %v", err)
+			s.mux.Lock()
+			s.lastErr = err
+			s.mux.Unlock()
+		}
+		lines = lines[n:]
+	}
+}
+
+//发送一批点，失败重试，重试的总时长不超过flushInterval，避免积压
+func (s *influxSink) send(lines [][]byte) error {
+	deadline := time.Now().Add(s.flushInterval)
+	var err error
+	for i := 0; i <= s.retries; i++ {
+		if i > 0 {
+			backoff := time.Duration(1<<uint(i-1)) * time.Second
+			if time.Now().Add(backoff).After(deadline) {
+				break
+			}
+			time.Sleep(backoff)
+		}
+		if s.conn != nil {
+			err = s.sendUDP(lines)
+		} else {
+			err = s.sendHTTP(lines, deadline)
+		}
+		if err == nil {
+			return nil
+		}
+		LOG_WARN_F("influx write fail (%d/%d): %v", i+1, s.retries+1, err)
+	}
+	return fmt.Errorf("drop %d points: %v", len(lines), err)
+}
+
+func (s *influxSink) sendHTTP(lines [][]byte, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(bytes.Join(lines, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx response %s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+//按行拼包，每个包不超过influxMaxUDPPayload
+func (s *influxSink) sendUDP(lines [][]byte) error {
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+len(line) > influxMaxUDPPayload {
+			if _, err := s.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = nil
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		if _, err := s.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *influxSink) Close() error {
+	close(s.stop)
+	<-s.done
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.lastErr
+}
+
+//解析 k=v,k2=v2 形式的tag列表
+func parseTagList(text string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, item := range strings.Split(text, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.New("bad tag " + item)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+//tag按key排序输出，influxdb推荐的写法
+func formatInfluxTags(tags map[string]string) string {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for _, k := range keys {
+		buf.WriteString(",")
+		buf.WriteString(escapeInflux(k, ",= "))
+		buf.WriteString("=")
+		buf.WriteString(escapeInflux(tags[k], ",= "))
+	}
+	return buf.String()
+}
+
+//line protocol转义，chars为需要加反斜杠的字符
+func escapeInflux(text, chars string) string {
+	var buf strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune(chars, r) {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
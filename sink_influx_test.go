@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//用测试的参数创建influx输出
+func newTestInfluxSink(t *testing.T, url string, batchSize int, flushInterval time.Duration) *influxSink {
+	config := sinkFlags.influx
+	config.url, config.batchSize, config.flushInterval, config.tags = url, batchSize, flushInterval, "host=test"
+
+	sink, err := newInfluxSink(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func testFlow(window int64) *RootNetFlow {
+	flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}})
+	flow.InBytes, flow.Ports[0].InBytes = 100, 100
+	flow.WindowEnd = window
+	return flow
+}
+
+func TestInfluxSinkSerializedSend(t *testing.T) {
+	var active, overlapped, points int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&points, int32(strings.Count(string(body), "\n")))
+		atomic.AddInt32(&active, -1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := newTestInfluxSink(t, server.URL, 4, time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				sink.Write(testFlow(int64(i*10 + j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//每条记录一个端口点和一个合计点
+	if points != 160 {
+		t.Errorf("points = %d, want 160", points)
+	}
+	if overlapped != 0 {
+		t.Error("writes to influx overlapped")
+	}
+}
+
+func TestInfluxSinkRetry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := newTestInfluxSink(t, server.URL, 2, 5*time.Second)
+	sink.Write(testFlow(1))
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+}
+
+func TestInfluxSinkRetryLimit(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	//重试的退避为1s、2s、4s，flushInterval为1.5s时只能重试一次
+	sink := newTestInfluxSink(t, server.URL, 2, 1500*time.Millisecond)
+	begin := time.Now()
+	sink.Write(testFlow(1))
+	if err := sink.Close(); err == nil {
+		t.Error("failed write not reported")
+	}
+	if elapsed := time.Since(begin); elapsed > 3*time.Second {
+		t.Errorf("flush took %v", elapsed)
+	}
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+}
+
+func TestInfluxSinkInterfaces(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := newTestInfluxSink(t, server.URL, 100, time.Hour)
+	flow := testFlow(2000)
+	flow.Interfaces = []*InterfaceNetFlow{{
+		Name: "eth 0", RxBytes: 4000, TxBytes: 2000, RxPackets: 40, TxPackets: 20,
+		RxErrors: 1, TxErrors: 2, RxDrops: 3, TxDrops: 4, RxRate: 2000, TxRate: 1000.5, Partial: true,
+	}}
+	sink.Write(flow)
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(<-bodies, "\n"), "\n")
+	want := `netflow_interface,interface=eth\ 0,host=test rx_bytes=4000i,tx_bytes=2000i,rx_packets=40i,tx_packets=20i,` +
+		`rx_errors=1i,tx_errors=2i,rx_drops=3i,tx_drops=4i,rx_rate=2000,tx_rate=1000.5,partial=true 2000000000`
+	if len(lines) != 3 || lines[2] != want {
+		t.Errorf("lines = %q, want interface point %q", lines, want)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+type netflowExportConfig struct {
+	addr            string
+	version         int
+	domain          uint
+	templateRefresh time.Duration
+}
+
+func init() {
+	flags := &sinkFlags.netflow
+	flagSet.StringVar(&flags.addr, "netflow.exportAddr", "127.0.0.1:2055", "address of the netflow/ipfix collector the netflow sink sends to (udp)")
+	flagSet.IntVar(&flags.version, "netflow.version", 9, "exported netflow version: 5|9|10 (ipfix)")
+	flagSet.UintVar(&flags.domain, "netflow.domain", 0, "source id (v9) / observation domain id (ipfix) / engine id (v5)")
+	flagSet.DurationVar(&flags.templateRefresh, "netflow.templateRefresh", time.Minute, "resend the template every duration")
+
+	RegisterSink("netflow", func(config *sinkConfig) (Sink, error) {
+		s, err := newNetflowSink(&config.netflow)
+		if err != nil {
+			return nil, err
+		}
+		//网卡的总流量不是流记录，不导出
+		if config.interfaces {
+			LOG_INFO("netflow sink exports port flows only, interface totals are not sent")
+		}
+		return s, nil
+	})
+}
+
+//一条导出的流记录：一个端口一个方向在一个采样窗口内的流量
+//入站记录的端口为目的端口，出站记录的端口为源端口，地址不可知均为0
+type netflowRecord struct {
+	srcPort   uint16
+	dstPort   uint16
+	proto     uint8
+	direction uint8
+	bytes     uint64
+	packets   uint64
+	start     int64 //unix毫秒
+	end       int64
+}
+
+//以netflow v5/v9或ipfix的格式把端口流量发送给流量分析系统
+type netflowSink struct {
+	conn    net.Conn
+	version int
+	domain  uint32
+
+	bootTime        time.Time //计算sysUptime，取启动时间和第一个窗口起点中较早的
+	sequence        uint32    //v5/ipfix为已发送的流记录数，v9为已发送的报文数
+	templateRefresh time.Duration
+	lastTemplate    time.Time
+}
+
+//v9模板，时间为相对sysUptime的毫秒数
+var netflowV9Fields = []netflowField{
+	{fieldL4SrcPort, 2},
+	{fieldL4DstPort, 2},
+	{fieldProtocol, 1},
+	{fieldDirection, 1},
+	{fieldInBytes, 8},
+	{fieldInPkts, 8},
+	{fieldFirstSwitched, 4},
+	{fieldLastSwitched, 4},
+}
+
+//ipfix模板，时间为unix毫秒
+var ipfixFields = []netflowField{
+	{fieldL4SrcPort, 2},
+	{fieldL4DstPort, 2},
+	{fieldProtocol, 1},
+	{fieldDirection, 1},
+	{fieldInBytes, 8},
+	{fieldInPkts, 8},
+	{fieldFlowStartMillis, 8},
+	{fieldFlowEndMillis, 8},
+}
+
+func newNetflowSink(config *netflowExportConfig) (*netflowSink, error) {
+	switch config.version {
+	case netflowV5, netflowV9, ipfixV10:
+	default:
+		return nil, fmt.Errorf("unsupported netflow.version[%d], available: 5,9,10", config.version)
+	}
+
+	conn, err := net.Dial("udp", config.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &netflowSink{
+		conn:            conn,
+		version:         config.version,
+		domain:          uint32(config.domain),
+		templateRefresh: config.templateRefresh,
+	}, nil
+}
+
+func (s *netflowSink) Write(flow *RootNetFlow) error {
+	//analyze时窗口早于启动时间，以第一个窗口作为sysUptime的起点
+	if s.bootTime.IsZero() {
+		s.bootTime = time.Now()
+		if start := time.Unix(0, flow.WindowStart*int64(time.Millisecond)); flow.WindowStart > 0 && start.Before(s.bootTime) {
+			s.bootTime = start
+		}
+	}
+
+	var records []*netflowRecord
+	for _, pf := range flow.Ports {
+		proto := protoNumbers[pf.Protocol]
+		if pf.InBytes > 0 || pf.InPackets > 0 {
+			records = append(records, &netflowRecord{
+				dstPort: uint16(pf.Port), proto: proto, direction: netflowDirectionIngress,
+				bytes: uint64(pf.InBytes), packets: uint64(pf.InPackets),
+				start: flow.WindowStart, end: flow.WindowEnd,
+			})
+		}
+		if pf.OutBytes > 0 || pf.OutPackets > 0 {
+			records = append(records, &netflowRecord{
+				srcPort: uint16(pf.Port), proto: proto, direction: netflowDirectionEgress,
+				bytes: uint64(pf.OutBytes), packets: uint64(pf.OutPackets),
+				start: flow.WindowStart, end: flow.WindowEnd,
+			})
+		}
+	}
+
+	//没有流量时v9/ipfix仍按时发送模板
+	var packets [][]byte
+	switch s.version {
+	case netflowV5:
+		packets = s.encodeV5(records)
+	case netflowV9:
+		packets = s.encodeTemplated(records, netflowV9Fields)
+	default:
+		packets = s.encodeTemplated(records, ipfixFields)
+	}
+
+	for _, packet := range packets {
+		if _, err := s.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//相对启动时间的毫秒数，早于启动时间的（如analyze中乱序的文件）取0
+func (s *netflowSink) uptime(unixMillis int64) uint32 {
+	uptime := unixMillis - s.bootTime.UnixNano()/int64(time.Millisecond)
+	if uptime < 0 {
+		return 0
+	}
+	return uint32(uptime)
+}
+
+// ------------  v5 ---------------
+
+//v5为固定格式，计数只有32位，超过的截断为最大值
+func (s *netflowSink) encodeV5(records []*netflowRecord) [][]byte {
+	var packets [][]byte
+	now := time.Now()
+	for len(records) > 0 {
+		count := len(records)
+		if count > netflowV5MaxCount {
+			count = netflowV5MaxCount
+		}
+
+		packet := make([]byte, netflowV5HeaderLen+count*netflowV5RecordLen)
+		binary.BigEndian.PutUint16(packet[0:], netflowV5)
+		binary.BigEndian.PutUint16(packet[2:], uint16(count))
+		binary.BigEndian.PutUint32(packet[4:], s.uptime(now.UnixNano()/int64(time.Millisecond)))
+		binary.BigEndian.PutUint32(packet[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(packet[12:], uint32(now.Nanosecond()))
+		binary.BigEndian.PutUint32(packet[16:], s.sequence)
+		packet[21] = uint8(s.domain) //engine_id
+
+		for i, record := range records[:count] {
+			r := packet[netflowV5HeaderLen+i*netflowV5RecordLen:]
+			binary.BigEndian.PutUint32(r[16:], clampUint32(record.packets))
+			binary.BigEndian.PutUint32(r[20:], clampUint32(record.bytes))
+			binary.BigEndian.PutUint32(r[24:], s.uptime(record.start))
+			binary.BigEndian.PutUint32(r[28:], s.uptime(record.end))
+			binary.BigEndian.PutUint16(r[32:], record.srcPort)
+			binary.BigEndian.PutUint16(r[34:], record.dstPort)
+			r[38] = record.proto
+		}
+
+		s.sequence += uint32(count)
+		records = records[count:]
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func clampUint32(value uint64) uint32 {
+	if value > 0xffffffff {
+		return 0xffffffff
+	}
+	return uint32(value)
+}
+
+// ------------  v9 / ipfix ---------------
+
+//按模板编码，第一个报文和每隔templateRefresh的报文带上模板
+func (s *netflowSink) encodeTemplated(records []*netflowRecord, fields []netflowField) [][]byte {
+	now := time.Now()
+	sendTemplate := s.lastTemplate.IsZero() || now.Sub(s.lastTemplate) >= s.templateRefresh
+	if !sendTemplate && len(records) == 0 {
+		return nil
+	}
+
+	recordLen := 0
+	for _, field := range fields {
+		recordLen += int(field.length)
+	}
+
+	headerLen := netflowV9HeaderLen
+	templateSetID := netflowV9TemplateSetID
+	if s.version == ipfixV10 {
+		headerLen = ipfixHeaderLen
+		templateSetID = ipfixTemplateSetID
+	}
+
+	var packets [][]byte
+	for sendTemplate || len(records) > 0 {
+		packet := make([]byte, headerLen, netflowExportMaxPacketSize)
+		count := 0 //v9头中的记录数，包括模板
+
+		if sendTemplate {
+			set := len(packet)
+			packet = appendUint16(packet, uint16(templateSetID), 0)
+			packet = appendUint16(packet, netflowExportTemplateID, uint16(len(fields)))
+			for _, field := range fields {
+				packet = appendUint16(packet, field.fieldType, field.length)
+			}
+			binary.BigEndian.PutUint16(packet[set+2:], uint16(len(packet)-set))
+			count++
+			sendTemplate = false
+			s.lastTemplate = now
+		}
+
+		dataRecords := 0
+		if len(records) > 0 {
+			set := len(packet)
+			packet = appendUint16(packet, netflowExportTemplateID, 0)
+			for len(records) > 0 && len(packet)+recordLen <= netflowExportMaxPacketSize {
+				packet = s.appendRecord(packet, records[0])
+				records = records[1:]
+				dataRecords++
+			}
+			//v9要求flowset按4字节对齐
+			for (len(packet)-set)%4 != 0 {
+				packet = append(packet, 0)
+			}
+			binary.BigEndian.PutUint16(packet[set+2:], uint16(len(packet)-set))
+			count += dataRecords
+		}
+
+		if s.version == ipfixV10 {
+			binary.BigEndian.PutUint16(packet[0:], ipfixV10)
+			binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+			binary.BigEndian.PutUint32(packet[4:], uint32(now.Unix()))
+			binary.BigEndian.PutUint32(packet[8:], s.sequence)
+			binary.BigEndian.PutUint32(packet[12:], s.domain)
+			s.sequence += uint32(dataRecords)
+		} else {
+			binary.BigEndian.PutUint16(packet[0:], netflowV9)
+			binary.BigEndian.PutUint16(packet[2:], uint16(count))
+			binary.BigEndian.PutUint32(packet[4:], s.uptime(now.UnixNano()/int64(time.Millisecond)))
+			binary.BigEndian.PutUint32(packet[8:], uint32(now.Unix()))
+			binary.BigEndian.PutUint32(packet[12:], s.sequence)
+			binary.BigEndian.PutUint32(packet[16:], s.domain)
+			s.sequence++
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+//按模板字段的顺序写入一条记录
+func (s *netflowSink) appendRecord(packet []byte, record *netflowRecord) []byte {
+	packet = appendUint16(packet, record.srcPort, record.dstPort)
+	packet = append(packet, record.proto, record.direction)
+	packet = binary.BigEndian.AppendUint64(packet, record.bytes)
+	packet = binary.BigEndian.AppendUint64(packet, record.packets)
+	if s.version == ipfixV10 {
+		packet = binary.BigEndian.AppendUint64(packet, uint64(record.start))
+		packet = binary.BigEndian.AppendUint64(packet, uint64(record.end))
+	} else {
+		packet = binary.BigEndian.AppendUint32(packet, s.uptime(record.start))
+		packet = binary.BigEndian.AppendUint32(packet, s.uptime(record.end))
+	}
+	return packet
+}
+
+func appendUint16(packet []byte, values ...uint16) []byte {
+	for _, value := range values {
+		packet = binary.BigEndian.AppendUint16(packet, value)
+	}
+	return packet
+}
+
+func (s *netflowSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+//用测试的参数创建netflow输出，返回输出和接收端
+func newTestNetflowSink(t *testing.T, version int) (*netflowSink, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := sinkFlags.netflow
+	config.addr, config.version = conn.LocalAddr().String(), version
+
+	sink, err := newNetflowSink(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink, conn
+}
+
+func readDatagram(t *testing.T, conn *net.UDPConn) []byte {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestNetflowSinkUptimeOfOldWindows(t *testing.T) {
+	sink, conn := newTestNetflowSink(t, netflowV5)
+	defer conn.Close()
+	defer sink.Close()
+
+	//analyze一年前的抓包
+	start := time.Now().Add(-365*24*time.Hour).UnixNano() / int64(time.Millisecond)
+	flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}})
+	flow.WindowStart, flow.WindowEnd = start, start+10000
+	flow.Ports[0].InBytes, flow.Ports[0].InPackets = 1000, 10
+	if err := sink.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := readDatagram(t, conn)
+	record := packet[netflowV5HeaderLen:]
+	first, last := binary.BigEndian.Uint32(record[24:]), binary.BigEndian.Uint32(record[28:])
+	if first != 0 || last != 10000 {
+		t.Errorf("first = %d, last = %d, want 0, 10000", first, last)
+	}
+
+	//比第一个窗口更早的窗口取0，不会下溢
+	flow.WindowStart, flow.WindowEnd = start-20000, start-10000
+	if err := sink.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+	packet = readDatagram(t, conn)
+	record = packet[netflowV5HeaderLen:]
+	first, last = binary.BigEndian.Uint32(record[24:]), binary.BigEndian.Uint32(record[28:])
+	if first != 0 || last != 0 {
+		t.Errorf("first = %d, last = %d of an earlier window, want 0", first, last)
+	}
+}
+
+func TestNetflowSinkUptimeOfLiveWindows(t *testing.T) {
+	sink, conn := newTestNetflowSink(t, netflowV9)
+	defer conn.Close()
+	defer sink.Close()
+
+	//实时采集时第一个窗口在启动之后，sysUptime从启动开始
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}})
+	flow.WindowStart, flow.WindowEnd = now+1000, now+2000
+	flow.Ports[0].OutBytes, flow.Ports[0].OutPackets = 1000, 10
+	if err := sink.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+	if first := sink.uptime(flow.WindowStart); first < 900 || first > 1100 {
+		t.Errorf("uptime of window start = %d, want about 1000", first)
+	}
+	readDatagram(t, conn)
+}
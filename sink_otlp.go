@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type otlpConfig struct {
+	endpoint   string
+	protocol   string
+	service    string
+	attributes string
+	headers    string
+	timeout    time.Duration
+	retries    int
+}
+
+const (
+	otlpHTTPPath = "/v1/metrics"
+	otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpScope    = "github.com/domac/go-netflow"
+
+	otlpTemporalityCumulative = 2
+)
+
+func init() {
+	flags := &sinkFlags.otlp
+	flagSet.StringVar(&flags.endpoint, "otlp.endpoint", "http://127.0.0.1:4318", "otlp receiver address, e.g. http://127.0.0.1:4318 for http or http://127.0.0.1:4317 for grpc")
+	flagSet.StringVar(&flags.protocol, "otlp.protocol", "http", "otlp transport: http|grpc")
+	flagSet.StringVar(&flags.service, "otlp.service", "go-netflow", "service.name resource attribute")
+	flagSet.StringVar(&flags.attributes, "otlp.attributes", "", "extra resource attributes, e.g. env=prod,dc=sh")
+	flagSet.StringVar(&flags.headers, "otlp.headers", "", "extra request headers, e.g. authorization=Bearer xxx")
+	flagSet.DurationVar(&flags.timeout, "otlp.timeout", 10*time.Second, "otlp export timeout, including retries")
+	flagSet.IntVar(&flags.retries, "otlp.retries", 3, "retries of an export failed with a retryable status")
+
+	RegisterSink("otlp", func(config *sinkConfig) (Sink, error) {
+		return newOTLPSink(&config.otlp)
+	})
+}
+
+//以otlp协议推送累计流量，每个端口每个方向一个累计单调递增的sum，开启-interfaces时另有网卡的sum
+//RootNetFlow中是窗口增量，这里自己累加，起始时间为第一个窗口的开始时间
+type otlpSink struct {
+	client   *http.Client
+	url      string
+	grpc     bool
+	headers  map[string]string
+	resource []byte //已编码的Resource
+	timeout  time.Duration
+	retries  int
+
+	startTime int64 //unix纳秒
+	totals    map[portSpec]*flowCounter
+	ifTotals  map[string]*otlpInterfaceTotal
+}
+
+//网卡的累计值，起始时间为第一次出现的窗口
+type otlpInterfaceTotal struct {
+	interfaceCounter
+	startTime int64
+}
+
+func newOTLPSink(config *otlpConfig) (*otlpSink, error) {
+	attributes, err := parseTagList(config.attributes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp.attributes: %v", err)
+	}
+	attributes["service.name"] = config.service
+	if _, ok := attributes["host.name"]; !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			attributes["host.name"] = hostname
+		}
+	}
+
+	headers, err := parseTagList(config.headers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp.headers: %v", err)
+	}
+
+	s := &otlpSink{
+		headers:  headers,
+		resource: encodeOTLPResource(attributes),
+		timeout:  config.timeout,
+		retries:  config.retries,
+		totals:   make(map[portSpec]*flowCounter),
+		ifTotals: make(map[string]*otlpInterfaceTotal),
+	}
+
+	endpoint := strings.TrimSuffix(config.endpoint, "/")
+	switch config.protocol {
+	case "http":
+		s.url = endpoint
+		if !strings.HasSuffix(s.url, otlpHTTPPath) {
+			s.url += otlpHTTPPath
+		}
+		s.client = &http.Client{}
+	case "grpc":
+		//grpc要求http2，http://地址使用明文http2（h2c）
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		s.grpc = true
+		s.url = endpoint + otlpGRPCPath
+		s.client = &http.Client{
+			Transport: &http.Transport{
+				Protocols: protocols,
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported otlp.protocol[%s], available: http,grpc", config.protocol)
+	}
+	if !strings.HasPrefix(s.url, "http://") && !strings.HasPrefix(s.url, "https://") {
+		return nil, fmt.Errorf("invalid otlp.endpoint[%s]", config.endpoint)
+	}
+	return s, nil
+}
+
+func (s *otlpSink) Write(flow *RootNetFlow) error {
+	if s.startTime == 0 {
+		s.startTime = flow.WindowStart * int64(time.Millisecond)
+	}
+	for _, pf := range flow.Ports {
+		spec := portSpec{proto: pf.Protocol, port: pf.Port}
+		total, ok := s.totals[spec]
+		if !ok {
+			total = &flowCounter{}
+			s.totals[spec] = total
+		}
+		total.inFlow += pf.InBytes
+		total.outFlow += pf.OutBytes
+		total.inPackets += pf.InPackets
+		total.outPackets += pf.OutPackets
+	}
+	for _, ifc := range flow.Interfaces {
+		total, ok := s.ifTotals[ifc.Name]
+		if !ok {
+			total = &otlpInterfaceTotal{startTime: flow.WindowStart * int64(time.Millisecond)}
+			s.ifTotals[ifc.Name] = total
+		}
+		total.rxBytes += ifc.RxBytes
+		total.txBytes += ifc.TxBytes
+		total.rxPackets += ifc.RxPackets
+		total.txPackets += ifc.TxPackets
+		total.rxErrors += ifc.RxErrors
+		total.txErrors += ifc.TxErrors
+		total.rxDrops += ifc.RxDrops
+		total.txDrops += ifc.TxDrops
+	}
+
+	body := s.encodeRequest(flow.WindowEnd * int64(time.Millisecond))
+	return s.export(body)
+}
+
+//可重试的导出错误：网络错误、http 429/502/503/504以及对应的grpc状态
+type otlpRetryableError struct {
+	err error
+}
+
+func (e *otlpRetryableError) Error() string {
+	return e.err.Error()
+}
+
+//可重试的错误按1s、2s、4s退避重试，重试的总时长不超过otlp.timeout，
+//数据是累计值，放弃的这次会由下一次导出补上
+func (s *otlpSink) export(body []byte) error {
+	deadline := time.Now().Add(s.timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for i := 0; ; i++ {
+		var err error
+		if s.grpc {
+			err = s.exportGRPC(ctx, body)
+		} else {
+			err = s.exportHTTP(ctx, body)
+		}
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*otlpRetryableError); !ok || i >= s.retries {
+			return err
+		}
+		backoff := time.Duration(1<<uint(i)) * time.Second
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		LOG_WARN_F("otlp export fail (%d/%d): %v", i+1, s.retries+1, err)
+		time.Sleep(backoff)
+	}
+}
+
+func otlpRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+//CANCELLED DEADLINE_EXCEEDED RESOURCE_EXHAUSTED ABORTED OUT_OF_RANGE UNAVAILABLE DATA_LOSS
+func otlpRetryableGRPCStatus(status string) bool {
+	switch status {
+	case "1", "4", "8", "10", "11", "14", "15":
+		return true
+	}
+	return false
+}
+
+func (s *otlpSink) exportHTTP(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return &otlpRetryableError{err}
+	}
+	defer rsp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+	if rsp.StatusCode/100 != 2 {
+		err = fmt.Errorf("otlp response %s: %s", rsp.Status, strings.TrimSpace(string(msg)))
+		if otlpRetryableStatus(rsp.StatusCode) {
+			return &otlpRetryableError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+//grpc消息格式：1字节压缩标志 + 4字节长度 + protobuf
+func (s *otlpSink) exportGRPC(ctx context.Context, body []byte) error {
+	frame := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+	frame = append(frame, body...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return &otlpRetryableError{err}
+	}
+	defer rsp.Body.Close()
+	//trailer要读完body后才有
+	_, _ = io.Copy(ioutil.Discard, rsp.Body)
+	if rsp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("otlp grpc response %s", rsp.Status)
+		if otlpRetryableStatus(rsp.StatusCode) {
+			return &otlpRetryableError{err}
+		}
+		return err
+	}
+
+	//出错且没有body时grpc-status可能在header中
+	status := rsp.Trailer.Get("Grpc-Status")
+	message := rsp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = rsp.Header.Get("Grpc-Status")
+		message = rsp.Header.Get("Grpc-Message")
+	}
+	if status != "" && status != "0" {
+		err = fmt.Errorf("otlp grpc status %s: %s", status, message)
+		if otlpRetryableGRPCStatus(status) {
+			return &otlpRetryableError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+// ------------  protobuf编码 ---------------
+
+//ExportMetricsServiceRequest，只有一个ResourceMetrics
+func (s *otlpSink) encodeRequest(now int64) []byte {
+	var specs []portSpec
+	for spec := range s.totals {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		if specs[i].port != specs[j].port {
+			return specs[i].port < specs[j].port
+		}
+		return specs[i].proto < specs[j].proto
+	})
+
+	bytesPoints := &protoBuffer{}
+	packetsPoints := &protoBuffer{}
+	for _, spec := range specs {
+		total := s.totals[spec]
+		port := strconv.Itoa(spec.port)
+		bytesPoints.message(1, encodeOTLPDataPoint(s.startTime, now, total.inFlow, "port", port, "proto", spec.proto, "direction", "in"))
+		bytesPoints.message(1, encodeOTLPDataPoint(s.startTime, now, total.outFlow, "port", port, "proto", spec.proto, "direction", "out"))
+		packetsPoints.message(1, encodeOTLPDataPoint(s.startTime, now, total.inPackets, "port", port, "proto", spec.proto, "direction", "in"))
+		packetsPoints.message(1, encodeOTLPDataPoint(s.startTime, now, total.outPackets, "port", port, "proto", spec.proto, "direction", "out"))
+	}
+
+	scope := &protoBuffer{}
+	scope.message(1, (&protoBuffer{}).string(1, otlpScope).bytes())
+	scope.message(2, encodeOTLPSum("netflow.bytes", "Bytes counted on the port.", "By", bytesPoints.bytes()))
+	scope.message(2, encodeOTLPSum("netflow.packets", "Packets counted on the port.", "{packet}", packetsPoints.bytes()))
+	if len(s.ifTotals) > 0 {
+		s.encodeInterfaces(scope, now)
+	}
+
+	resourceMetrics := &protoBuffer{}
+	resourceMetrics.message(1, s.resource)
+	resourceMetrics.message(2, scope.bytes())
+
+	return (&protoBuffer{}).message(1, resourceMetrics.bytes()).bytes()
+}
+
+//网卡的sum，属性为interface和direction（rx/tx），按网卡名排序
+func (s *otlpSink) encodeInterfaces(scope *protoBuffer, now int64) {
+	var names []string
+	for name := range s.ifTotals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []struct {
+		name        string
+		description string
+		unit        string
+		values      func(c *interfaceCounter) (int64, int64)
+	}{
+		{"netflow.interface.bytes", "Bytes on the interface reported by the kernel.", "By",
+			func(c *interfaceCounter) (int64, int64) { return c.rxBytes, c.txBytes }},
+		{"netflow.interface.packets", "Packets on the interface reported by the kernel.", "{packet}",
+			func(c *interfaceCounter) (int64, int64) { return c.rxPackets, c.txPackets }},
+		{"netflow.interface.errors", "Errors on the interface reported by the kernel.", "{error}",
+			func(c *interfaceCounter) (int64, int64) { return c.rxErrors, c.txErrors }},
+		{"netflow.interface.drops", "Dropped packets on the interface reported by the kernel.", "{packet}",
+			func(c *interfaceCounter) (int64, int64) { return c.rxDrops, c.txDrops }},
+	}
+	for _, metric := range metrics {
+		points := &protoBuffer{}
+		for _, name := range names {
+			total := s.ifTotals[name]
+			rx, tx := metric.values(&total.interfaceCounter)
+			points.message(1, encodeOTLPDataPoint(total.startTime, now, rx, "interface", name, "direction", "rx"))
+			points.message(1, encodeOTLPDataPoint(total.startTime, now, tx, "interface", name, "direction", "tx"))
+		}
+		scope.message(2, encodeOTLPSum(metric.name, metric.description, metric.unit, points.bytes()))
+	}
+}
+
+//NumberDataPoint，labels为属性的key、value对
+func encodeOTLPDataPoint(start, now, value int64, labels ...string) []byte {
+	point := &protoBuffer{}
+	point.fixed64(2, uint64(start))
+	point.fixed64(3, uint64(now))
+	point.fixed64(6, uint64(value)) //as_int
+	for i := 0; i+1 < len(labels); i += 2 {
+		point.message(7, encodeOTLPKeyValue(labels[i], labels[i+1]))
+	}
+	return point.bytes()
+}
+
+//Metric，数据为累计单调递增的Sum
+func encodeOTLPSum(name, description, unit string, points []byte) []byte {
+	sum := &protoBuffer{}
+	sum.raw(points)
+	sum.varint(2, otlpTemporalityCumulative)
+	sum.varint(3, 1) //is_monotonic
+
+	metric := &protoBuffer{}
+	metric.string(1, name)
+	metric.string(2, description)
+	metric.string(3, unit)
+	metric.message(7, sum.bytes())
+	return metric.bytes()
+}
+
+//Resource，属性按key排序
+func encodeOTLPResource(attributes map[string]string) []byte {
+	var keys []string
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	resource := &protoBuffer{}
+	for _, k := range keys {
+		resource.message(1, encodeOTLPKeyValue(k, attributes[k]))
+	}
+	return resource.bytes()
+}
+
+//KeyValue，值为AnyValue.string_value
+func encodeOTLPKeyValue(key, value string) []byte {
+	kv := &protoBuffer{}
+	kv.string(1, key)
+	kv.message(2, (&protoBuffer{}).string(1, value).bytes())
+	return kv.bytes()
+}
+
+//只实现用到的几种protobuf字段类型
+type protoBuffer struct {
+	buf []byte
+}
+
+func (pb *protoBuffer) bytes() []byte {
+	return pb.buf
+}
+
+func (pb *protoBuffer) raw(data []byte) *protoBuffer {
+	pb.buf = append(pb.buf, data...)
+	return pb
+}
+
+func (pb *protoBuffer) tag(field int, wireType int) {
+	pb.buf = binary.AppendUvarint(pb.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (pb *protoBuffer) varint(field int, value uint64) *protoBuffer {
+	pb.tag(field, 0)
+	pb.buf = binary.AppendUvarint(pb.buf, value)
+	return pb
+}
+
+func (pb *protoBuffer) fixed64(field int, value uint64) *protoBuffer {
+	pb.tag(field, 1)
+	pb.buf = binary.LittleEndian.AppendUint64(pb.buf, value)
+	return pb
+}
+
+func (pb *protoBuffer) message(field int, data []byte) *protoBuffer {
+	pb.tag(field, 2)
+	pb.buf = binary.AppendUvarint(pb.buf, uint64(len(data)))
+	pb.buf = append(pb.buf, data...)
+	return pb
+}
+
+func (pb *protoBuffer) string(field int, value string) *protoBuffer {
+	return pb.message(field, []byte(value))
+}
+
+func (s *otlpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//测试中解码protobuf用的字段
+type protoField struct {
+	num   int
+	value uint64 //varint和fixed64
+	data  []byte //length-delimited
+}
+
+func decodeProto(t *testing.T, data []byte) []protoField {
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("bad protobuf tag")
+		}
+		data = data[n:]
+		field := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			field.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				t.Fatalf("bad protobuf varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				t.Fatalf("bad protobuf fixed64")
+			}
+			field.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				t.Fatalf("bad protobuf length")
+			}
+			field.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			t.Fatalf("unexpected protobuf wire type %d", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+//取某个编号的所有字段
+func protoFields(t *testing.T, data []byte, num int) []protoField {
+	var fields []protoField
+	for _, field := range decodeProto(t, data) {
+		if field.num == num {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+//取唯一的嵌套消息
+func protoMessage(t *testing.T, data []byte, num int) []byte {
+	fields := protoFields(t, data, num)
+	if len(fields) != 1 {
+		t.Fatalf("%d fields of number %d, want 1", len(fields), num)
+	}
+	return fields[0].data
+}
+
+//KeyValue列表转成map，值都是AnyValue.string_value
+func protoAttributes(t *testing.T, data []byte, num int) map[string]string {
+	attributes := make(map[string]string)
+	for _, kv := range protoFields(t, data, num) {
+		value := protoMessage(t, kv.data, 2)
+		attributes[string(protoMessage(t, kv.data, 1))] = string(protoMessage(t, value, 1))
+	}
+	return attributes
+}
+
+func newTestOTLPSink(t *testing.T, endpoint string, timeout time.Duration) *otlpSink {
+	config := sinkFlags.otlp
+	config.endpoint, config.attributes, config.timeout = endpoint, "env=test,host.name=node1", timeout
+
+	sink, err := newOTLPSink(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestOTLPSinkExport(t *testing.T) {
+	bodies := make(chan []byte, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpHTTPPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	sink := newTestOTLPSink(t, server.URL, 5*time.Second)
+	defer sink.Close()
+
+	flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}})
+	flow.WindowStart, flow.WindowEnd = 1000, 2000
+	flow.Ports[0].InBytes, flow.Ports[0].OutBytes, flow.Ports[0].InPackets, flow.Ports[0].OutPackets = 300, 200, 3, 2
+	if err := sink.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+	<-bodies
+	//第二个窗口，数据点为累计值
+	flow.WindowStart, flow.WindowEnd = 2000, 3000
+	if err := sink.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+	body := <-bodies
+
+	resourceMetrics := protoMessage(t, body, 1)
+	resource := protoMessage(t, resourceMetrics, 1)
+	attributes := protoAttributes(t, resource, 1)
+	if attributes["service.name"] != "go-netflow" || attributes["env"] != "test" || attributes["host.name"] != "node1" {
+		t.Errorf("resource attributes = %v", attributes)
+	}
+
+	scopeMetrics := protoMessage(t, resourceMetrics, 2)
+	if scope := protoMessage(t, scopeMetrics, 1); string(protoMessage(t, scope, 1)) != otlpScope {
+		t.Errorf("scope = %q", protoMessage(t, scope, 1))
+	}
+
+	metrics := protoFields(t, scopeMetrics, 2)
+	want := map[string][2]int64{
+		"netflow.bytes":   {600, 400},
+		"netflow.packets": {6, 4},
+	}
+	if len(metrics) != len(want) {
+		t.Fatalf("%d metrics, want %d", len(metrics), len(want))
+	}
+	for _, metric := range metrics {
+		name := string(protoMessage(t, metric.data, 1))
+		values, ok := want[name]
+		if !ok {
+			t.Errorf("unexpected metric %s", name)
+			continue
+		}
+
+		sum := protoMessage(t, metric.data, 7)
+		if temporality := protoFields(t, sum, 2); len(temporality) != 1 || temporality[0].value != otlpTemporalityCumulative {
+			t.Errorf("%s temporality = %v", name, temporality)
+		}
+		if monotonic := protoFields(t, sum, 3); len(monotonic) != 1 || monotonic[0].value != 1 {
+			t.Errorf("%s is not monotonic", name)
+		}
+
+		points := protoFields(t, sum, 1)
+		if len(points) != 2 {
+			t.Fatalf("%s has %d points, want 2", name, len(points))
+		}
+		for i, point := range points {
+			labels := protoAttributes(t, point.data, 7)
+			direction := [2]string{"in", "out"}[i]
+			if labels["port"] != "8080" || labels["proto"] != "tcp" || labels["direction"] != direction {
+				t.Errorf("%s point %d labels = %v", name, i, labels)
+			}
+			start := protoFields(t, point.data, 2)[0].value
+			ts := protoFields(t, point.data, 3)[0].value
+			value := int64(protoFields(t, point.data, 6)[0].value)
+			if start != uint64(time.Second) || ts != uint64(3*time.Second) || value != values[i] {
+				t.Errorf("%s %s point = start %d time %d value %d, want value %d", name, direction, start, ts, value, values[i])
+			}
+		}
+	}
+}
+
+func TestOTLPSinkInterfaces(t *testing.T) {
+	bodies := make(chan []byte, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	sink := newTestOTLPSink(t, server.URL, 5*time.Second)
+	defer sink.Close()
+
+	flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}})
+	flow.WindowStart, flow.WindowEnd = 1000, 2000
+	flow.Interfaces = []*InterfaceNetFlow{{Name: "eth0", RxBytes: 1000, TxBytes: 500, RxPackets: 10, TxPackets: 5, RxErrors: 1, TxDrops: 2}}
+	if err := sink.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+	<-bodies
+	//eth1在第二个窗口出现，起始时间为该窗口的开始时间
+	flow.WindowStart, flow.WindowEnd = 2000, 3000
+	flow.Interfaces = append(flow.Interfaces, &InterfaceNetFlow{Name: "eth1", RxBytes: 7, TxBytes: 8})
+	if err := sink.Write(flow); err != nil {
+		t.Fatal(err)
+	}
+	body := <-bodies
+
+	scopeMetrics := protoMessage(t, protoMessage(t, body, 1), 2)
+	want := map[string][]int64{
+		"netflow.interface.bytes":   {2000, 1000, 7, 8},
+		"netflow.interface.packets": {20, 10, 0, 0},
+		"netflow.interface.errors":  {2, 0, 0, 0},
+		"netflow.interface.drops":   {0, 4, 0, 0},
+	}
+	found := 0
+	for _, metric := range protoFields(t, scopeMetrics, 2) {
+		name := string(protoMessage(t, metric.data, 1))
+		values, ok := want[name]
+		if !ok {
+			continue
+		}
+		found++
+
+		sum := protoMessage(t, metric.data, 7)
+		if temporality := protoFields(t, sum, 2); len(temporality) != 1 || temporality[0].value != otlpTemporalityCumulative {
+			t.Errorf("%s temporality = %v", name, temporality)
+		}
+		points := protoFields(t, sum, 1)
+		if len(points) != 4 {
+			t.Fatalf("%s has %d points, want 4", name, len(points))
+		}
+		for i, point := range points {
+			labels := protoAttributes(t, point.data, 7)
+			ifName := [2]string{"eth0", "eth1"}[i/2]
+			direction := [2]string{"rx", "tx"}[i%2]
+			if labels["interface"] != ifName || labels["direction"] != direction || len(labels) != 2 {
+				t.Errorf("%s point %d labels = %v", name, i, labels)
+			}
+			start := protoFields(t, point.data, 2)[0].value
+			value := int64(protoFields(t, point.data, 6)[0].value)
+			if start != uint64(i/2+1)*uint64(time.Second) || value != values[i] {
+				t.Errorf("%s %s %s point = start %d value %d, want value %d", name, ifName, direction, start, value, values[i])
+			}
+		}
+	}
+	if found != len(want) {
+		t.Errorf("%d interface metrics, want %d", found, len(want))
+	}
+}
+
+func TestOTLPSinkRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		timeout  time.Duration
+		requests int32
+		fail     bool
+	}{
+		{"retry after 503", []int{http.StatusServiceUnavailable, http.StatusOK}, 5 * time.Second, 2, false},
+		{"retry after 429 and 502", []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK}, 5 * time.Second, 3, false},
+		{"no retry on 400", []int{http.StatusBadRequest}, 5 * time.Second, 1, true},
+		{"no retry on 500", []int{http.StatusInternalServerError}, 5 * time.Second, 1, true},
+		//第一次退避1s后，第二次退避2s会超过2.5s的超时，放弃
+		{"give up at timeout", []int{503, 503, 503, 503, 503}, 2500 * time.Millisecond, 2, true},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			i := atomic.AddInt32(&requests, 1) - 1
+			if int(i) < len(test.statuses) && test.statuses[i] != http.StatusOK {
+				http.Error(w, "fail", test.statuses[i])
+			}
+		}))
+
+		sink := newTestOTLPSink(t, server.URL, test.timeout)
+		flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}})
+		err := sink.Write(flow)
+		if (err != nil) != test.fail {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+		if requests != test.requests {
+			t.Errorf("%s: requests = %d, want %d", test.name, requests, test.requests)
+		}
+		sink.Close()
+		server.Close()
+	}
+}
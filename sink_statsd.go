@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type statsdConfig struct {
+	addr      string
+	prefix    string
+	typ       string
+	dogstatsd bool
+}
+
+//udp单个包的最大长度，statsd agent推荐值
+const statsdMaxUDPPayload = 1432
+
+func init() {
+	flags := &sinkFlags.statsd
+	flagSet.StringVar(&flags.addr, "statsd.addr", "127.0.0.1:8125", "statsd agent address (udp)")
+	flagSet.StringVar(&flags.prefix, "statsd.prefix", "netflow", "prefix of the statsd metric names")
+	flagSet.StringVar(&flags.typ, "statsd.type", "counter", "statsd metric type: counter (window delta)|gauge (per second rate)")
+	flagSet.BoolVar(&flags.dogstatsd, "statsd.dogstatsd", false, "send port, proto and host as dogstatsd tags instead of in the metric name")
+
+	RegisterSink("statsd", func(config *sinkConfig) (Sink, error) {
+		return newStatsdSink(&config.statsd)
+	})
+}
+
+//以statsd协议发送各端口的流量，counter发送每个采样窗口的增量，gauge发送每秒速率
+type statsdSink struct {
+	conn      net.Conn
+	prefix    string
+	typ       string //c 或 g
+	dogstatsd bool
+	host      string
+}
+
+func newStatsdSink(config *statsdConfig) (*statsdSink, error) {
+	s := &statsdSink{
+		prefix:    strings.TrimSuffix(config.prefix, "."),
+		dogstatsd: config.dogstatsd,
+	}
+	switch config.typ {
+	case "counter":
+		s.typ = "c"
+	case "gauge":
+		s.typ = "g"
+	default:
+		return nil, fmt.Errorf("unsupported statsd.type[%s], available: counter,gauge", config.typ)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		s.host = hostname
+	}
+
+	conn, err := net.Dial("udp", config.addr)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	return s, nil
+}
+
+//statsd的值，counter为增量，gauge为速率
+type statsdValue struct {
+	name  string
+	value string
+}
+
+func (s *statsdSink) Write(flow *RootNetFlow) error {
+	var lines []string
+	for _, pf := range flow.Ports {
+		var values []statsdValue
+		if s.typ == "g" {
+			values = []statsdValue{
+				{"in_rate", formatStatsdFloat(pf.InRate)},
+				{"out_rate", formatStatsdFloat(pf.OutRate)},
+				{"in_packet_rate", formatStatsdFloat(pf.InPacketRate)},
+				{"out_packet_rate", formatStatsdFloat(pf.OutPacketRate)},
+			}
+		} else {
+			values = []statsdValue{
+				{"in_bytes", strconv.FormatInt(pf.InBytes, 10)},
+				{"out_bytes", strconv.FormatInt(pf.OutBytes, 10)},
+				{"in_packets", strconv.FormatInt(pf.InPackets, 10)},
+				{"out_packets", strconv.FormatInt(pf.OutPackets, 10)},
+			}
+		}
+		for _, v := range values {
+			lines = append(lines, s.line(pf, v.name, v.value))
+		}
+	}
+
+	//网卡的包速率按窗口长度换算
+	seconds := float64(flow.WindowEnd-flow.WindowStart) / 1000
+	for _, ifc := range flow.Interfaces {
+		var values []statsdValue
+		if s.typ == "g" {
+			values = []statsdValue{
+				{"rx_rate", formatStatsdFloat(ifc.RxRate)},
+				{"tx_rate", formatStatsdFloat(ifc.TxRate)},
+			}
+			if seconds > 0 {
+				values = append(values,
+					statsdValue{"rx_packet_rate", formatStatsdFloat(float64(ifc.RxPackets) / seconds)},
+					statsdValue{"tx_packet_rate", formatStatsdFloat(float64(ifc.TxPackets) / seconds)},
+				)
+			}
+		} else {
+			values = []statsdValue{
+				{"rx_bytes", strconv.FormatInt(ifc.RxBytes, 10)},
+				{"tx_bytes", strconv.FormatInt(ifc.TxBytes, 10)},
+				{"rx_packets", strconv.FormatInt(ifc.RxPackets, 10)},
+				{"tx_packets", strconv.FormatInt(ifc.TxPackets, 10)},
+				{"rx_errors", strconv.FormatInt(ifc.RxErrors, 10)},
+				{"tx_errors", strconv.FormatInt(ifc.TxErrors, 10)},
+				{"rx_drops", strconv.FormatInt(ifc.RxDrops, 10)},
+				{"tx_drops", strconv.FormatInt(ifc.TxDrops, 10)},
+			}
+		}
+		for _, v := range values {
+			lines = append(lines, s.interfaceLine(ifc.Name, v.name, v.value))
+		}
+	}
+	return s.send(lines)
+}
+
+//statsd的值不支持指数形式
+func formatStatsdFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+//dogstatsd: netflow.in_bytes:10|c|#port:8080,proto:tcp,host:a
+//statsd:    netflow.tcp_8080.in_bytes:10|c
+func (s *statsdSink) line(pf *PortNetFlow, name string, value string) string {
+	if s.dogstatsd {
+		tags := "port:" + strconv.Itoa(pf.Port) + ",proto:" + pf.Protocol
+		if s.host != "" {
+			tags += ",host:" + s.host
+		}
+		return fmt.Sprintf("%s.%s:%s|%s|#%s", s.prefix, name, value, s.typ, tags)
+	}
+	return fmt.Sprintf("%s.%s_%d.%s:%s|%s", s.prefix, pf.Protocol, pf.Port, name, value, s.typ)
+}
+
+//dogstatsd: netflow.interface.rx_bytes:10|c|#interface:eth0,host:a
+//statsd:    netflow.interface.eth0.rx_bytes:10|c
+func (s *statsdSink) interfaceLine(ifName string, name string, value string) string {
+	if s.dogstatsd {
+		tags := "interface:" + statsdTagEscaper.Replace(ifName)
+		if s.host != "" {
+			tags += ",host:" + s.host
+		}
+		return fmt.Sprintf("%s.interface.%s:%s|%s|#%s", s.prefix, name, value, s.typ, tags)
+	}
+	return fmt.Sprintf("%s.interface.%s.%s:%s|%s", s.prefix, statsdNode(ifName), name, value, s.typ)
+}
+
+//tag的值中不能有tag和字段的分隔符
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+//指标名中的statsd分隔符替换为下划线，如vlan接口 eth0.100
+func statsdNode(text string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(".:|@#, \t\n", r) {
+			return '_'
+		}
+		return r
+	}, text)
+}
+
+//按行拼包，每个包不超过statsdMaxUDPPayload
+func (s *statsdSink) send(lines []string) error {
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxUDPPayload {
+			if _, err := s.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		if _, err := s.conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//用测试的参数创建statsd输出，返回输出和接收端
+func newTestStatsdSink(t *testing.T, typ string) (*statsdSink, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := sinkFlags.statsd
+	config.addr, config.typ = conn.LocalAddr().String(), typ
+
+	sink, err := newStatsdSink(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink, conn
+}
+
+func readStatsdLines(t *testing.T, conn *net.UDPConn) []string {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func TestStatsdSinkTypes(t *testing.T) {
+	flow := newRootNetFlow([]portSpec{{proto: "tcp", port: 8080}})
+	pf := flow.Ports[0]
+	pf.InBytes, pf.OutBytes, pf.InPackets, pf.OutPackets = 3000, 1500, 20, 10
+	pf.InRate, pf.OutRate, pf.InPacketRate, pf.OutPacketRate = 300, 150.5, 2, 0.000001
+
+	tests := []struct {
+		typ   string
+		lines []string
+	}{
+		{"counter", []string{
+			"netflow.tcp_8080.in_bytes:3000|c",
+			"netflow.tcp_8080.out_bytes:1500|c",
+			"netflow.tcp_8080.in_packets:20|c",
+			"netflow.tcp_8080.out_packets:10|c",
+		}},
+		{"gauge", []string{
+			"netflow.tcp_8080.in_rate:300|g",
+			"netflow.tcp_8080.out_rate:150.5|g",
+			"netflow.tcp_8080.in_packet_rate:2|g",
+			"netflow.tcp_8080.out_packet_rate:0.000001|g",
+		}},
+	}
+	for _, test := range tests {
+		sink, conn := newTestStatsdSink(t, test.typ)
+		if err := sink.Write(flow); err != nil {
+			t.Fatal(err)
+		}
+		if lines := readStatsdLines(t, conn); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s lines = %q, want %q", test.typ, lines, test.lines)
+		}
+		sink.Close()
+		conn.Close()
+	}
+}
+
+func TestStatsdSinkInterfaces(t *testing.T) {
+	flow := newRootNetFlow(nil)
+	flow.WindowStart, flow.WindowEnd = 1000, 3000
+	flow.Interfaces = []*InterfaceNetFlow{{
+		Name: "eth0.100", RxBytes: 4000, TxBytes: 2000, RxPackets: 40, TxPackets: 20,
+		RxErrors: 1, TxErrors: 2, RxDrops: 3, TxDrops: 4, RxRate: 2000, TxRate: 1000,
+	}}
+
+	tests := []struct {
+		typ       string
+		dogstatsd bool
+		lines     []string
+	}{
+		{"counter", false, []string{
+			"netflow.interface.eth0_100.rx_bytes:4000|c",
+			"netflow.interface.eth0_100.tx_bytes:2000|c",
+			"netflow.interface.eth0_100.rx_packets:40|c",
+			"netflow.interface.eth0_100.tx_packets:20|c",
+			"netflow.interface.eth0_100.rx_errors:1|c",
+			"netflow.interface.eth0_100.tx_errors:2|c",
+			"netflow.interface.eth0_100.rx_drops:3|c",
+			"netflow.interface.eth0_100.tx_drops:4|c",
+		}},
+		//包速率按2s的窗口换算
+		{"gauge", true, []string{
+			"netflow.interface.rx_rate:2000|g|#interface:eth0.100,host:a",
+			"netflow.interface.tx_rate:1000|g|#interface:eth0.100,host:a",
+			"netflow.interface.rx_packet_rate:20|g|#interface:eth0.100,host:a",
+			"netflow.interface.tx_packet_rate:10|g|#interface:eth0.100,host:a",
+		}},
+	}
+	for _, test := range tests {
+		sink, conn := newTestStatsdSink(t, test.typ)
+		sink.dogstatsd, sink.host = test.dogstatsd, "a"
+		if err := sink.Write(flow); err != nil {
+			t.Fatal(err)
+		}
+		if lines := readStatsdLines(t, conn); !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s lines = %q, want %q", test.typ, lines, test.lines)
+		}
+		sink.Close()
+		conn.Close()
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//记录写入的输出，release之前Write一直阻塞
+type blockingSink struct {
+	mux     sync.Mutex
+	flows   []*RootNetFlow
+	release chan struct{}
+}
+
+func (s *blockingSink) Write(flow *RootNetFlow) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mux.Lock()
+	s.flows = append(s.flows, flow)
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func (s *blockingSink) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.flows)
+}
+
+func TestSinkDispatcherSlowSink(t *testing.T) {
+	fast := &blockingSink{}
+	slow := &blockingSink{release: make(chan struct{})}
+
+	dispatcher := &sinkDispatcher{}
+	fastWorker := dispatcher.add("fast", fast, 2)
+	slowWorker := dispatcher.add("slow", slow, 2)
+
+	//慢输出阻塞在第一条上，队列再放2条，其余都丢弃
+	const total = 10
+	for i := 0; i < total; i++ {
+		dispatcher.dispatch(newRootNetFlow(nil))
+		//等快输出取走，避免它的小队列满
+		deadline := time.Now().Add(time.Second)
+		for fast.count() < i+1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		//等慢输出取走第一条并阻塞
+		for i == 0 && len(slowWorker.queue) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if n := fast.count(); n != total {
+		t.Errorf("fast sink got %d flows, want %d", n, total)
+	}
+	if dropped := atomic.LoadUint64(&fastWorker.dropped); dropped != 0 {
+		t.Errorf("fast sink dropped %d", dropped)
+	}
+	if dropped := atomic.LoadUint64(&slowWorker.dropped); dropped != total-3 {
+		t.Errorf("slow sink dropped %d, want %d", dropped, total-3)
+	}
+
+	//关闭时写完队列中的数据
+	close(slow.release)
+	dispatcher.Close()
+	if n := slow.count(); n != 3 {
+		t.Errorf("slow sink got %d flows, want 3", n)
+	}
+
+	//关闭后不再分发
+	dispatcher.dispatch(newRootNetFlow(nil))
+	if n := fast.count(); n != total {
+		t.Errorf("fast sink got %d flows after close", n)
+	}
+}
@@ -0,0 +1,286 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+//直接通过getsockopt读取内核x_tables规则计数，等价于libiptc的读取部分，
+//一次调用即可拿到整张表所有规则的计数，不再需要fork iptables/grep/awk
+
+const (
+	iptSoGetInfo    = 64 //IPT_SO_GET_INFO，ip6tables相同
+	iptSoGetEntries = 65 //IPT_SO_GET_ENTRIES，ip6tables相同
+
+	xtTableMaxNameLen     = 32
+	xtExtensionMaxNameLen = 29
+	xtEntryMatchHeadLen   = 32 //u16 size + name[29] + u8 revision
+	xtGetInfoLen          = 84 //name[32] + valid_hooks + hook_entry[5] + underflow[5] + num_entries + size
+
+	xtReturn = -5 //XT_RETURN = -NF_REPEAT - 1
+
+	nfInetNumHooks = 5
+)
+
+var (
+	//netfilter的hook编号即内置链
+	xtHookChains = [nfInetNumHooks]string{"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"}
+
+	//u64在结构体中的对齐，决定ipt_get_entries.entrytable的偏移
+	xtCounterAlign = int(unsafe.Alignof(uint64(0)))
+)
+
+//ipt_entry的内存布局
+type xtLayout struct {
+	family         int
+	level          int
+	protoOffset    int
+	targetOffset   int //target_offset字段的位置，next_offset紧随其后
+	countersOffset int
+	entrySize      int
+}
+
+var xtLayouts = [...]*xtLayout{
+	familyIPv4: {
+		family:         syscall.AF_INET,
+		level:          syscall.SOL_IP,
+		protoOffset:    80,
+		targetOffset:   88,
+		countersOffset: 96,
+		entrySize:      112,
+	},
+	//ip6t_entry：ip6t_ip6占136字节，counters按u64对齐
+	familyIPv6: {
+		family:         syscall.AF_INET6,
+		level:          syscall.SOL_IPV6,
+		protoOffset:    128,
+		targetOffset:   140,
+		countersOffset: alignUp(148, xtCounterAlign),
+		entrySize:      alignUp(148, xtCounterAlign) + 16,
+	},
+}
+
+//一条规则（不包含链头、内置链的默认策略以及自定义链的隐式RETURN）
+type xtRule struct {
+	chain   string
+	proto   uint16
+	matches []*xtMatch
+	target  string
+	packets uint64
+	bytes   uint64
+}
+
+type xtMatch struct {
+	name string
+	data []byte
+}
+
+//查找指定名称的match
+func (rule *xtRule) match(name string) *xtMatch {
+	for _, m := range rule.matches {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+//读取指定表的所有规则
+func getXtablesRules(layout *xtLayout, table string) ([]*xtRule, error) {
+	fd, err := syscall.Socket(layout.family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	//规则在两次调用之间发生变化时内核返回EAGAIN，重试几次
+	for i := 0; i < 3; i++ {
+		info := make([]byte, xtGetInfoLen)
+		copy(info, table)
+		if err = getsockopt(fd, layout.level, iptSoGetInfo, info); err != nil {
+			return nil, fmt.Errorf("get %s info: %v", table, err)
+		}
+
+		var hookEntry, underflow [nfInetNumHooks]uint32
+		validHooks := binary.NativeEndian.Uint32(info[32:])
+		for h := 0; h < nfInetNumHooks; h++ {
+			hookEntry[h] = binary.NativeEndian.Uint32(info[36+4*h:])
+			underflow[h] = binary.NativeEndian.Uint32(info[56+4*h:])
+		}
+		size := binary.NativeEndian.Uint32(info[80:])
+
+		head := alignUp(xtTableMaxNameLen+4, xtCounterAlign)
+		entries := make([]byte, head+int(size))
+		copy(entries, table)
+		binary.NativeEndian.PutUint32(entries[32:], size)
+		err = getsockopt(fd, layout.level, iptSoGetEntries, entries)
+		if err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s entries: %v", table, err)
+		}
+
+		return parseXtablesEntries(layout, entries[head:], validHooks, hookEntry, underflow)
+	}
+	return nil, fmt.Errorf("get %s entries: %v", table, err)
+}
+
+//解析ipt_entry数组
+func parseXtablesEntries(layout *xtLayout, blob []byte, validHooks uint32, hookEntry, underflow [nfInetNumHooks]uint32) ([]*xtRule, error) {
+
+	type entry struct {
+		rule    *xtRule
+		verdict int32
+		skip    bool
+		isHead  bool
+	}
+
+	var all []*entry
+	chain := ""
+	for offset := 0; offset < len(blob); {
+		if offset+layout.entrySize > len(blob) {
+			return nil, errors.New("truncated xtables entry")
+		}
+		e := blob[offset:]
+		targetOffset := int(binary.NativeEndian.Uint16(e[layout.targetOffset:]))
+		nextOffset := int(binary.NativeEndian.Uint16(e[layout.targetOffset+2:]))
+		if nextOffset <= 0 || offset+nextOffset > len(blob) || targetOffset < layout.entrySize || targetOffset+xtEntryMatchHeadLen > nextOffset {
+			return nil, errors.New("malformed xtables entry")
+		}
+
+		underflowed := false
+		for h := 0; h < nfInetNumHooks; h++ {
+			if validHooks&(1<<uint(h)) == 0 {
+				continue
+			}
+			if uint32(offset) == hookEntry[h] {
+				chain = xtHookChains[h]
+			}
+			if uint32(offset) == underflow[h] {
+				underflowed = true
+			}
+		}
+
+		rule := &xtRule{
+			chain:   chain,
+			proto:   binary.NativeEndian.Uint16(e[layout.protoOffset:]),
+			packets: binary.NativeEndian.Uint64(e[layout.countersOffset:]),
+			bytes:   binary.NativeEndian.Uint64(e[layout.countersOffset+8:]),
+		}
+
+		for pos := layout.entrySize; pos+xtEntryMatchHeadLen <= targetOffset; {
+			matchSize := int(binary.NativeEndian.Uint16(e[pos:]))
+			if matchSize < xtEntryMatchHeadLen || pos+matchSize > targetOffset {
+				return nil, errors.New("malformed xtables match")
+			}
+			rule.matches = append(rule.matches, &xtMatch{
+				name: cString(e[pos+2 : pos+2+xtExtensionMaxNameLen]),
+				data: e[pos+xtEntryMatchHeadLen : pos+matchSize],
+			})
+			pos += matchSize
+		}
+
+		target := e[targetOffset:nextOffset]
+		rule.target = cString(target[2 : 2+xtExtensionMaxNameLen])
+		targetData := target[xtEntryMatchHeadLen:]
+
+		ent := &entry{rule: rule, skip: underflowed}
+		switch rule.target {
+		case "":
+			//标准target，data为verdict
+			if len(targetData) >= 4 {
+				ent.verdict = int32(binary.NativeEndian.Uint32(targetData))
+			}
+		case "ERROR":
+			//自定义链的链头，errorname即链名，表尾的ERROR节点同样跳过
+			chain = cString(targetData)
+			ent.skip = true
+			ent.isHead = true
+		}
+		all = append(all, ent)
+		offset += nextOffset
+	}
+
+	var rules []*xtRule
+	for i, ent := range all {
+		//自定义链的最后一条是隐式的RETURN
+		if i+1 < len(all) && all[i+1].isHead && ent.rule.target == "" && ent.verdict == xtReturn {
+			continue
+		}
+		if !ent.skip {
+			rules = append(rules, ent.rule)
+		}
+	}
+	return rules, nil
+}
+
+func getsockopt(fd, level, name int, buf []byte) error {
+	l := uint32(len(buf))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&l)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func alignUp(n, align int) int {
+	return (n + align - 1) &^ (align - 1)
+}
+
+//一次读取所有端口的iptables计数，两个方向都读不到的端口不出现在结果中
+func readIptablesCounters(family int, portsList []portSpec) (map[flowKey]*flowCounter, error) {
+	rules, err := getXtablesRules(xtLayouts[family], "filter")
+	if err != nil {
+		return nil, err
+	}
+
+	inFlows := make(map[portSpec]*ruleCounter)
+	outFlows := make(map[portSpec]*ruleCounter)
+	for _, rule := range rules {
+		if rule.chain != iptablesInChain && rule.chain != iptablesOutChain {
+			continue
+		}
+
+		//只认带自有注释的规则
+		m := rule.match("comment")
+		if m == nil {
+			continue
+		}
+		spec, direction, ok := parseIptablesTag(cString(m.data))
+		if !ok {
+			continue
+		}
+
+		switch direction {
+		case "in":
+			addRuleCounter(inFlows, spec, int64(rule.packets), int64(rule.bytes))
+		case "out":
+			addRuleCounter(outFlows, spec, int64(rule.packets), int64(rule.bytes))
+		}
+	}
+
+	counters := make(map[flowKey]*flowCounter, len(portsList))
+	for _, spec := range portsList {
+		inFlow := inFlows[spec]
+		outFlow := outFlows[spec]
+		if inFlow != nil || outFlow != nil {
+			counters[flowKey{portSpec: spec, family: family}] = newFlowCounter(inFlow, outFlow)
+		}
+	}
+	return counters, nil
+}
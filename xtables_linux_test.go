@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+//按内核头文件独立写出的结构偏移，不使用xtLayout中的值，用于校验手算的布局
+//ipt_entry: ipt_ip(84) nfcache target_offset next_offset comefrom counters elems
+//ip6t_entry: ip6t_ip6(136) nfcache target_offset next_offset comefrom counters(u64对齐) elems
+type xtTestLayout struct {
+	proto, target, counters, size int
+}
+
+var xtTestLayouts = [...]xtTestLayout{
+	familyIPv4: {80, 88, 96, 112},
+	familyIPv6: {128, 140, 152, 168},
+}
+
+//xt_entry_match/xt_entry_target：u16 size + name[29] + u8 revision + data，按8字节对齐
+func xtTestExtension(name string, data []byte) []byte {
+	ext := make([]byte, alignUp(xtEntryMatchHeadLen+len(data), 8))
+	binary.NativeEndian.PutUint16(ext, uint16(len(ext)))
+	copy(ext[2:], name)
+	copy(ext[xtEntryMatchHeadLen:], data)
+	return ext
+}
+
+func xtTestComment(comment string) []byte {
+	data := make([]byte, 256)
+	copy(data, comment)
+	return xtTestExtension("comment", data)
+}
+
+func xtTestVerdict(verdict int32) []byte {
+	data := make([]byte, 4)
+	binary.NativeEndian.PutUint32(data, uint32(verdict))
+	return xtTestExtension("", data)
+}
+
+func xtTestError(name string) []byte {
+	data := make([]byte, 30)
+	copy(data, name)
+	return xtTestExtension("ERROR", data)
+}
+
+type xtTestEntry struct {
+	proto          uint16
+	packets, bytes uint64
+	matches        [][]byte
+	target         []byte
+	hook           int //>=0时为内置链的入口
+	underflow      int //>=0时为内置链的默认策略
+}
+
+func buildXtablesBlob(l xtTestLayout, entries []xtTestEntry) ([]byte, [nfInetNumHooks]uint32, [nfInetNumHooks]uint32) {
+	var blob []byte
+	var hookEntry, underflow [nfInetNumHooks]uint32
+	for _, te := range entries {
+		if te.hook >= 0 {
+			hookEntry[te.hook] = uint32(len(blob))
+		}
+		if te.underflow >= 0 {
+			underflow[te.underflow] = uint32(len(blob))
+		}
+		e := make([]byte, l.size)
+		binary.NativeEndian.PutUint16(e[l.proto:], te.proto)
+		binary.NativeEndian.PutUint64(e[l.counters:], te.packets)
+		binary.NativeEndian.PutUint64(e[l.counters+8:], te.bytes)
+		for _, m := range te.matches {
+			e = append(e, m...)
+		}
+		binary.NativeEndian.PutUint16(e[l.target:], uint16(len(e)))
+		e = append(e, te.target...)
+		binary.NativeEndian.PutUint16(e[l.target+2:], uint16(len(e)))
+		blob = append(blob, e...)
+	}
+	return blob, hookEntry, underflow
+}
+
+//filter表：INPUT有一条跳转规则，FORWARD/OUTPUT只有默认策略，之后是两个自定义链和表尾
+func testXtablesEntries() []xtTestEntry {
+	const accept, jump = -2, 1024
+	none := -1
+	return []xtTestEntry{
+		{proto: 6, packets: 5, bytes: 500, target: xtTestVerdict(jump), hook: 1, underflow: none},
+		{packets: 99, bytes: 9900, target: xtTestVerdict(accept), hook: none, underflow: 1},
+		{target: xtTestVerdict(accept), hook: 2, underflow: 2},
+		{target: xtTestVerdict(accept), hook: 3, underflow: 3},
+		{target: xtTestError(iptablesInChain), hook: none, underflow: none},
+		//显式的RETURN不是链的最后一条，不能当作隐式RETURN跳过
+		{proto: 6, packets: 10, bytes: 1000, matches: [][]byte{xtTestComment("netflow:tcp/8080:in")}, target: xtTestVerdict(xtReturn), hook: none, underflow: none},
+		{proto: 17, packets: 1, bytes: 60, matches: [][]byte{xtTestExtension("udp", make([]byte, 8)), xtTestComment("netflow:udp/53:in")}, target: xtTestVerdict(accept), hook: none, underflow: none},
+		//隐式RETURN
+		{target: xtTestVerdict(xtReturn), hook: none, underflow: none},
+		{target: xtTestError(iptablesOutChain), hook: none, underflow: none},
+		{proto: 6, packets: 20, bytes: 3000, matches: [][]byte{xtTestExtension("tcp", make([]byte, 16)), xtTestComment("netflow:tcp/8080:out")}, target: xtTestVerdict(accept), hook: none, underflow: none},
+		{target: xtTestVerdict(xtReturn), hook: none, underflow: none},
+		//表尾
+		{target: xtTestError("ERROR"), hook: none, underflow: none},
+	}
+}
+
+func TestParseXtablesEntries(t *testing.T) {
+	if xtCounterAlign != 8 {
+		t.Skip("test layouts assume 8 byte aligned u64")
+	}
+	want := []struct {
+		chain          string
+		proto          uint16
+		matches        []string
+		comment        string
+		packets, bytes uint64
+	}{
+		{"INPUT", 6, nil, "", 5, 500},
+		{iptablesInChain, 6, []string{"comment"}, "netflow:tcp/8080:in", 10, 1000},
+		{iptablesInChain, 17, []string{"udp", "comment"}, "netflow:udp/53:in", 1, 60},
+		{iptablesOutChain, 6, []string{"tcp", "comment"}, "netflow:tcp/8080:out", 20, 3000},
+	}
+
+	for family, l := range xtTestLayouts {
+		name := familyNames[family]
+		blob, hookEntry, underflow := buildXtablesBlob(l, testXtablesEntries())
+		rules, err := parseXtablesEntries(xtLayouts[family], blob, 1<<1|1<<2|1<<3, hookEntry, underflow)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(rules) != len(want) {
+			t.Fatalf("%s: %d rules, want %d", name, len(rules), len(want))
+		}
+		for i, w := range want {
+			rule := rules[i]
+			if rule.chain != w.chain || rule.proto != w.proto || rule.packets != w.packets || rule.bytes != w.bytes {
+				t.Errorf("%s rule %d = %s proto %d %d/%d", name, i, rule.chain, rule.proto, rule.packets, rule.bytes)
+			}
+			var matches []string
+			for _, m := range rule.matches {
+				matches = append(matches, m.name)
+			}
+			if strings.Join(matches, ",") != strings.Join(w.matches, ",") {
+				t.Errorf("%s rule %d matches = %v, want %v", name, i, matches, w.matches)
+			}
+			if m := rule.match("comment"); w.comment != "" && (m == nil || cString(m.data) != w.comment) {
+				t.Errorf("%s rule %d has no comment %s", name, i, w.comment)
+			}
+		}
+	}
+}
+
+func TestParseXtablesMalformed(t *testing.T) {
+	l := xtTestLayouts[familyIPv4]
+	blob, hookEntry, underflow := buildXtablesBlob(l, testXtablesEntries())
+
+	badNext := append([]byte{}, blob...)
+	binary.NativeEndian.PutUint16(badNext[l.target+2:], 0)
+	badMatch := append([]byte{}, blob...)
+	//第6条规则的comment match长度超出target
+	offset := 0
+	for i := 0; i < 5; i++ {
+		offset += int(binary.NativeEndian.Uint16(badMatch[offset+l.target+2:]))
+	}
+	binary.NativeEndian.PutUint16(badMatch[offset+l.size:], 4096)
+
+	tests := []struct {
+		name string
+		blob []byte
+	}{
+		{"truncated", blob[:len(blob)-10]},
+		{"zero next offset", badNext},
+		{"match past target", badMatch},
+	}
+	for _, test := range tests {
+		if _, err := parseXtablesEntries(xtLayouts[familyIPv4], test.blob, 1<<1|1<<2|1<<3, hookEntry, underflow); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
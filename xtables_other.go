@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+func readIptablesCounters(family int, portsList []portSpec) (map[flowKey]*flowCounter, error) {
+	return nil, errors.New("xtables is only supported on linux")
+}